@@ -0,0 +1,45 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ServeAPI answers HTTP requests for the state of this host on the APIAddr address
+func ServeAPI() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/interfaces", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		err := e.Encode(InterfaceSnapshot())
+		if err != nil {
+			Debug("API: %v", err)
+		}
+	})
+	Info("API: listening on %s", APIAddr)
+	go func() {
+		err := http.ListenAndServe(APIAddr, mux)
+		if err != nil {
+			Warn("API: %v", err)
+		}
+	}()
+}
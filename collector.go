@@ -0,0 +1,310 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Reports queued for each collector before more are dropped, and the time allowed to connect or write
+	CollectorQueue   = 64
+	CollectorTimeout = 5 * time.Second
+
+	// Longest wait before accepting again after a temporary error such as running out of file descriptors
+	CollectorBackoff = time.Second
+)
+
+var (
+	CollectorUDP *Socket
+	CollectorTCP net.Listener
+	Collectors   = make(map[string]*Collector)
+
+	// Guarded by Mutex, the error that stopped the TCP listener
+	CollectorTCPErr error
+)
+
+// Collector is an outgoing connection used to send reports by unicast to a collector. Reports are queued to a goroutine that owns the connection, so a stalled collector cannot hold up sending.
+type Collector struct {
+	Key     string
+	Network string
+	Addr    string
+	Queue   chan []byte
+	Stalled bool
+
+	// Guarded by Mutex
+	Err error
+}
+
+// Send queues a report for the collector, dropping it if the queue is full. Mutex must be held.
+func (c *Collector) Send(b []byte) {
+	if c.Network == "tcp" {
+		// Reports are framed with a length prefix on TCP
+		f := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+		b = append(f, b...)
+	}
+	select {
+	case c.Queue <- b:
+		if c.Stalled {
+			c.Stalled = false
+			Info("Collector %s is keeping up again", c.Key)
+		}
+	default:
+		if !c.Stalled {
+			c.Stalled = true
+			Warn("Collector %s is not keeping up, dropping reports", c.Key)
+		}
+	}
+}
+
+// Fail records the first error of a collector, so CheckCollectors deletes it
+func (c *Collector) Fail(err error) {
+	Mutex.Lock()
+	if c.Err == nil {
+		c.Err = err
+	}
+	Mutex.Unlock()
+}
+
+// Run connects to the collector and writes the queued reports until the queue is closed or a write fails
+func (c *Collector) Run() {
+	conn, err := net.DialTimeout(c.Network, c.Addr, CollectorTimeout)
+	if err != nil {
+		Event(LevelWarn, Attrs{"event": "collector_error", "collector": c.Key, "error": err}, "Collector %s: net.Dial(%s, %s): %v", c.Key, c.Network, c.Addr, err)
+		c.Fail(err)
+		return
+	}
+	defer conn.Close()
+	Debug("Collector %s: Conn.LocalAddr = %v", c.Key, conn.LocalAddr())
+
+	// Collectors never send anything back, so a read only returns when the connection fails
+	go func() {
+		b := make([]byte, 70000)
+		for {
+			_, err := conn.Read(b)
+			if err != nil {
+				if c.Network == "tcp" {
+					c.Fail(err)
+				}
+				return
+			}
+		}
+	}()
+
+	for b := range c.Queue {
+		err = conn.SetWriteDeadline(time.Now().Add(CollectorTimeout))
+		if err == nil {
+			_, err = conn.Write(b)
+		}
+		if err != nil {
+			Warn("Collector %s: %v", c.Key, err)
+			c.Fail(err)
+			return
+		}
+		if c.Network == "udp" {
+			src, _ := conn.LocalAddr().(*net.UDPAddr)
+			dst, _ := conn.RemoteAddr().(*net.UDPAddr)
+			if src != nil && dst != nil {
+				Capture.Write(src, dst, PcapUnknownTTL, 0, false, PcapOutbound, b, time.Now())
+			}
+		}
+	}
+}
+
+// ParseCollector splits a collector address into a network and host:port, using CollectorPort if no port is given
+func ParseCollector(s string) (network string, addr string) {
+	network = "udp"
+	if i := strings.Index(s, "://"); i != -1 {
+		network, s = strings.ToLower(s[:i]), s[i+3:]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(strings.Trim(s, "[]"), strconv.Itoa(CollectorPort))
+	}
+	return network, s
+}
+
+func CheckCollectors() {
+	if CollectorUDP != nil && CollectorUDP.Err != nil {
+		Warn("Deleting collector UDP listener due to error: %v", CollectorUDP.Err)
+		CollectorUDP.Close()
+		CollectorUDP = nil
+	}
+
+	// The listener is recreated on the next pass of the socket loop
+	Mutex.Lock()
+	err := CollectorTCPErr
+	CollectorTCPErr = nil
+	Mutex.Unlock()
+	if CollectorTCP != nil && err != nil {
+		Warn("Deleting collector TCP listener due to error: %v", err)
+		CollectorTCP.Close()
+		CollectorTCP = nil
+	}
+
+	Mutex.Lock()
+	for key, c := range Collectors {
+		if c.Err != nil {
+			Event(LevelWarn, Attrs{"event": "collector_delete", "collector": key, "error": c.Err}, "Deleting connection to collector %s due to error: %v", key, c.Err)
+			// Closing the queue ends the goroutine, which closes the connection
+			close(c.Queue)
+			delete(Collectors, key)
+		}
+	}
+	Mutex.Unlock()
+}
+
+func MakeCollectors() {
+	for _, key := range CollectorAddrs {
+		Mutex.Lock()
+		exists := Collectors[key] != nil
+		Mutex.Unlock()
+		if exists {
+			continue
+		}
+
+		c := &Collector{Key: key, Queue: make(chan []byte, CollectorQueue)}
+		c.Network, c.Addr = ParseCollector(key)
+		Event(LevelInfo, Attrs{"event": "collector_create", "collector": key}, "Making connection to collector %s://%s", c.Network, c.Addr)
+		go c.Run()
+
+		Mutex.Lock()
+		Collectors[key] = c
+		Mutex.Unlock()
+	}
+}
+
+func MakeCollectorListeners() {
+	if CollectorUDP == nil {
+		Info("Making collector UDP listener on port %d", CollectorPort)
+		s := &Socket{}
+		a := net.UDPAddr{Port: CollectorPort}
+		s.Conn, s.Err = net.ListenUDP("udp", &a)
+		if s.Err != nil {
+			Warn("Collector: net.ListenUDP(udp, %v): %v", a, s.Err)
+		} else {
+			go func() {
+				b := make([]byte, 70000)
+				var n int
+				var from *net.UDPAddr
+				var r *Report
+				for {
+					n, from, s.Err = s.Conn.ReadFromUDP(b)
+					if n > 0 {
+						r = Decode(b[:n])
+						if r != nil {
+							t := Now()
+							Capture.Write(from, s.Conn.LocalAddr().(*net.UDPAddr), PcapUnknownTTL, 0, false, PcapInbound, b[:n], t)
+							Recording.Report(IngressCollector, from, 0, nil, b[:n], t)
+							Mutex.Lock()
+							StoreReport(r, t)
+							Mutex.Unlock()
+						}
+					}
+					if s.Err != nil {
+						Warn("Collector: Conn.ReadFromUDP(b): %v", s.Err)
+						return
+					}
+				}
+			}()
+			CollectorUDP = s
+		}
+	}
+
+	if CollectorTCP == nil {
+		Info("Making collector TCP listener on port %d", CollectorPort)
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(CollectorPort))
+		if err != nil {
+			Warn("Collector: net.Listen(tcp, :%d): %v", CollectorPort, err)
+			return
+		}
+		go AcceptCollectorConns(l)
+		CollectorTCP = l
+	}
+}
+
+// AcceptCollectorConns reads reports from each connection to the TCP listener, until it is closed or fails
+func AcceptCollectorConns(l net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Wait longer after each temporary error, like net/http, so the loop does not spin
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				if delay == 0 {
+					Warn("Collector: Accept: %v", err)
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > CollectorBackoff {
+					delay = CollectorBackoff
+				}
+				time.Sleep(delay)
+				continue
+			}
+			Warn("Collector: Accept: %v", err)
+			Mutex.Lock()
+			CollectorTCPErr = err
+			Mutex.Unlock()
+			return
+		}
+		if delay > 0 {
+			Info("Collector: Accept is working again")
+			delay = 0
+		}
+		Debug("Collector: connection from %v", conn.RemoteAddr())
+		go ReadCollectorConn(conn)
+	}
+}
+
+func ReadCollectorConn(conn net.Conn) {
+	defer conn.Close()
+	l := make([]byte, 4)
+	b := make([]byte, 70000)
+	for {
+		_, err := io.ReadFull(conn, l)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				Debug("Collector: %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		n := int(binary.BigEndian.Uint32(l))
+		if n > len(b) {
+			Warn("Collector: %v: report of %d bytes is too large", conn.RemoteAddr(), n)
+			return
+		}
+		_, err = io.ReadFull(conn, b[:n])
+		if err != nil {
+			Debug("Collector: %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		r := Decode(b[:n])
+		if r != nil {
+			t := Now()
+			Recording.Report(IngressCollector, conn.RemoteAddr(), 0, nil, b[:n], t)
+			Mutex.Lock()
+			StoreReport(r, t)
+			Mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// FailingListener returns each of its errors from Accept in turn
+type FailingListener struct {
+	net.Listener
+	Errs  []error
+	Calls int
+}
+
+func (l *FailingListener) Accept() (net.Conn, error) {
+	l.Calls++
+	err := l.Errs[0]
+	if len(l.Errs) > 1 {
+		l.Errs = l.Errs[1:]
+	}
+	return nil, err
+}
+
+func TestAcceptCollectorConns(t *testing.T) {
+	defer func() { CollectorTCPErr = nil }()
+
+	// Running out of file descriptors is retried with a backoff, and other errors stop the listener
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	failed := errors.New("listener failed")
+	l := &FailingListener{Errs: []error{emfile, emfile, emfile, failed}}
+	start := time.Now()
+	AcceptCollectorConns(l)
+	if l.Calls != 4 {
+		t.Errorf("Accept called %d times, want 4", l.Calls)
+	}
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("three temporary errors took %v, want a backoff of at least 35ms", elapsed)
+	}
+	if CollectorTCPErr != failed {
+		t.Errorf("CollectorTCPErr = %v, want %v", CollectorTCPErr, failed)
+	}
+
+	// Closing on purpose is not an error
+	CollectorTCPErr = nil
+	AcceptCollectorConns(&FailingListener{Errs: []error{net.ErrClosed}})
+	if CollectorTCPErr != nil {
+		t.Errorf("CollectorTCPErr = %v after closing, want nil", CollectorTCPErr)
+	}
+}
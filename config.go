@@ -19,6 +19,7 @@ import (
 	"github.com/dlclark/regexp2"
 	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/pflag"
+	"io"
 	"net"
 	"os"
 	"strings"
@@ -26,6 +27,11 @@ import (
 	"time"
 )
 
+const (
+	// Longest a regex may take to match a single address, interface, or search
+	MatchTimeout = 100 * time.Millisecond
+)
+
 var (
 	// User-controllable
 	Group          net.IP
@@ -34,11 +40,45 @@ var (
 	Rate           int
 	QoS            int
 	Fragments      bool
+	CapSize        bool
 	Size           int
+	MaxSize        int
+	Protocol       int
+	TTLSweep       int
+	MTUSweep       []int
+	Delta          bool
 	LinkLocal      bool
+	Stale          time.Duration
+	HistoryLength  time.Duration
 	AddressRegex   string
 	InterfaceRegex string
+	Role           string
+	Unicast        bool
+	CollectorAddrs []string
+	CollectorPort  int
+	Export         string
+	RecordFile     string
+	PcapFile       string
+	APIAddr        string
+	PimEnabled     bool
+	IgmpEnabled    bool
+	QuerierRegex   string
+	QueryVersion   int
+	MtraceRouter   string
+	MtraceHops     int
+	MtraceStub     bool
+	ReplaySpeed    float64
 	Verbose        bool
+	LogFile        string
+	LogFileSize    int
+	LogFileKeep    int
+	LogStderr      bool
+	SyslogSocket   string
+	ConfigFile     string
+	Replay         string
+	PimFile        string
+	IgmpFile       string
+	MtraceSource   string
 
 	// Automatic
 	Host      string
@@ -48,13 +88,20 @@ var (
 	Mutex      = new(sync.Mutex)
 	HeardHosts = make(map[string]time.Time)
 	HeardIPs   = make(map[string]time.Time)
+	HeardAddrs = make(map[string]*net.UDPAddr)
+	HostIPs    = make(map[string]string)
+	Beacons    = make(map[string]bool)
 	HeardDb    = make(map[string]map[string]time.Duration)
 
 	// Other
 	AddressFilter   *regexp2.Regexp
 	InterfaceFilter *regexp2.Regexp
+	QuerierFilter   *regexp2.Regexp
 	ZstdEncoder     *zstd.Encoder
 	ZstdDecoder     *zstd.Decoder
+	Padding         int
+	Reconfigure     = make(chan Settings, 1)
+	Flags           *pflag.FlagSet
 )
 
 func Configure() {
@@ -70,106 +117,705 @@ func Configure() {
 	}
 	Info("Host = %s", Host)
 
-	// Read command-line options
 	flags := pflag.NewFlagSet("macy", pflag.ExitOnError)
 	flags.SortFlags = false
-	flags.IPVarP(&Group, "group", "g", net.ParseIP("239.239.239.239"), "multicast group address")
-	flags.IntVarP(&Port, "port", "p", 23923, "UDP port number")
-	flags.IntVarP(&TTL, "ttl", "t", 1, "maximum hop count aka Time To Live")
-	flags.IntVarP(&Rate, "rate", "r", 2, "transmit rate in hertz")
-	flags.IntVarP(&QoS, "qos", "q", 0, "DiffServ CodePoint for QoS (default 0)")
+	Flags = flags
+	var settings Settings
+	SettingsFlags(flags, &settings)
 	flags.BoolVarP(&Fragments, "fragments", "f", false, "allow packet fragmentation")
-	flags.IntVarP(&Size, "size", "s", 0, "payload size before fragmentation (default 0)")
+	flags.BoolVar(&CapSize, "capsize", false, "reduce the -s/--size padding so reports fit the smallest interface MTU when fragmentation is off")
+	flags.IntVarP(&MaxSize, "max", "m", 1400, "maximum payload size before reports are split into parts")
+	flags.IntVarP(&Protocol, "protocol", "P", 2, "report protocol version, 0 is readable by all releases")
+	flags.BoolVarP(&Delta, "delta", "d", false, "delta-encode addresses in reports")
+	flags.IntVar(&TTLSweep, "ttlsweep", 0, "cycle the TTL of reports from 1 to this value, stamping it in each report so receivers find the minimum TTL needed (default none)")
+	flags.IntSliceVar(&MTUSweep, "mtusweep", nil, "also send probes padded to each of these payload sizes in turn with the DF-bit set, so receivers find the largest that arrives (default none)")
 	flags.BoolVarP(&LinkLocal, "linklocal", "l", false, "include link-local addresses")
-	flags.StringVarP(&AddressRegex, "addresses", "a", "", "use addresses that match this regex (default \"\")")
-	flags.StringVarP(&InterfaceRegex, "interfaces", "i", "", "use interfaces that match this regex (default \"\")")
+	flags.DurationVarP(&Stale, "stale", "S", 5*time.Second, "time since last heard before a path is considered down")
+	flags.DurationVarP(&HistoryLength, "history", "H", 5*time.Minute, "length of history shown in graphs")
+	flags.StringVarP(&Role, "role", "o", "full", "full, beacon (send only), listener (receive only), or collector")
+	flags.BoolVarP(&Unicast, "unicast", "u", true, "listeners send reports by unicast to the senders they hear")
+	flags.StringSliceVarP(&CollectorAddrs, "collectors", "c", nil, "also send reports to these collectors, as [udp|tcp://]host[:port] (default none)")
+	flags.IntVarP(&CollectorPort, "collectorport", "C", 23924, "UDP and TCP port number for collectors")
+	flags.StringVarP(&Export, "export", "x", "", "write the Reports table to this .csv, .json, or .md file on exit, and with the time added when X is pressed (default none)")
+	flags.StringVarP(&RecordFile, "record", "R", "", "append received reports and socket events to this file, which \"macy replay file\" plays back (default none)")
+	flags.StringVar(&PcapFile, "pcap", "", "write the datagrams sent and received to this pcapng file (default none)")
+	flags.StringVar(&APIAddr, "api", "", "serve the state of this host as JSON over HTTP on this address, such as localhost:8080 (default none)")
+	flags.BoolVar(&PimEnabled, "pim", false, "analyze PIM packets on the usable interfaces, which needs privileges for raw sockets")
+	flags.BoolVar(&IgmpEnabled, "igmp", false, "observe IGMP or MLD queriers and members on the usable interfaces, which needs privileges for raw sockets")
+	flags.StringVar(&QuerierRegex, "querier", "", "send IGMP or MLD queries on interfaces that match this regex unless a querier with a lower address is present, which implies --igmp (default none)")
+	flags.IntVar(&QueryVersion, "queryversion", 3, "IGMP version of queries, 2 or 3, where MLD queries are always version 2")
+	flags.StringVar(&MtraceRouter, "mtracerouter", "", "send mtrace queries to this router, the last hop of the receiver traced from (default the routers on the local link)")
+	flags.IntVar(&MtraceHops, "mtracehops", 32, "maximum number of hops traced by mtrace")
+	flags.BoolVar(&MtraceStub, "mtraceresponder", false, "answer mtrace queries on UDP port 33435 as if this host were the router of its receivers")
+	flags.Float64Var(&ReplaySpeed, "speed", 1, "replay speed, where 2 plays back twice as fast")
 	flags.BoolVarP(&Verbose, "verbose", "v", false, "include debug messages in log")
+	flags.StringVar(&LogFile, "logfile", "", "also write the log to this file as JSON lines (default none)")
+	flags.IntVar(&LogFileSize, "logsize", 10, "size in megabytes before the log file is rotated")
+	flags.IntVar(&LogFileKeep, "logkeep", 5, "number of rotated log files to keep")
+	flags.BoolVar(&LogStderr, "stderr", false, "also write the log to stderr as text, redirected with 2>file while the TUI is running")
+	flags.StringVar(&SyslogSocket, "syslog", "", "also send the log to syslog over this unix socket, such as /dev/log (default none)")
+	flags.StringVar(&ConfigFile, "config", "", "read options from this file, and again on SIGHUP (default none)")
 	var help bool
 	flags.BoolVarP(&help, "help", "h", false, "display usage information")
 	err = flags.MarkHidden("help")
 	if err != nil {
 		Warn("flags.MarkHidden: %v", err)
 	}
-	err = flags.Parse(os.Args[1:])
+
+	// Read options from the configuration file followed by the command line, so command-line options take precedence
+	args, err := ConfigArgs()
 	if err != nil {
-		Warn("flags.Parse(%v): %v", os.Args[1:], err)
+		Fatal("%v", err)
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		Warn("flags.Parse(%v): %v", args, err)
 	}
 	if help {
 		fmt.Printf("Usage of macy:\n")
 		flags.PrintDefaults()
 		os.Exit(0)
 	}
+	Group, Port, TTL, Rate, QoS, Size = settings.Group, settings.Port, settings.TTL, settings.Rate, settings.QoS, settings.Size
+	AddressRegex, InterfaceRegex = settings.AddressRegex, settings.InterfaceRegex
 
 	// Check command line options
+	Info("Config file = \"%s\"", ConfigFile)
+
 	Info("Group = %v", Group)
 	if !Group.IsMulticast() {
 		Fatal("%s is not a multicast group address", Group)
 	}
-	if Group.To4() != nil {
-		Transport = "udp4"
-	} else {
-		Transport = "udp6"
-	}
+	Transport = TransportFor(Group)
 	Info("Transport = %v", Transport)
 
 	Info("Port = %v", Port)
-	if Port < 1 || Port > 65535 {
-		Fatal("Port must be between 1 and 65535")
+	err = CheckPort(Port)
+	if err != nil {
+		Fatal("%v", err)
 	}
 
 	Info("TTL = %v", TTL)
-	if TTL < 0 || TTL > 255 {
-		Fatal("TTL must be between 0 and 255")
+	err = CheckTTL(TTL)
+	if err != nil {
+		Fatal("%v", err)
 	}
 	if TTL <= 1 {
 		Warn("Reports will not be forwarded beyond the attached subnets")
 	}
 
 	Info("Rate = %v Hz", Rate)
-	if Rate < 1 {
-		Fatal("Rate must be greater than 0")
+	err = CheckRate(Rate)
+	if err != nil {
+		Fatal("%v", err)
 	}
 
 	Info("QoS = %v", QoS)
-	if QoS < 0 || QoS > 63 {
-		Fatal("QoS must be between 0 and 63")
+	err = CheckQoS(QoS)
+	if err != nil {
+		Fatal("%v", err)
 	}
 
 	Info("Fragments = %v", Fragments)
+	Info("Cap size = %v", CapSize)
 
 	Info("Size = %v", Size)
-	switch Transport {
-	case "udp4":
-		if Size < 0 || Size > 65507 {
-			Fatal("Size must be between 0 and 65507 for IPv4")
+	err = CheckSize(Size, Transport)
+	if err != nil {
+		Fatal("%v", err)
+	}
+
+	Info("MaxSize = %v", MaxSize)
+	err = CheckMaxSize(MaxSize, Transport)
+	if err != nil {
+		Fatal("%v", err)
+	}
+
+	Info("Protocol = %v", Protocol)
+	if Protocol < 0 || Protocol > 2 {
+		Fatal("Protocol must be between 0 and 2")
+	}
+	if Protocol == 0 {
+		Warn("Reports will not be split into parts with protocol version 0")
+	}
+
+	Info("Delta = %v", Delta)
+	if Delta && Protocol < 2 {
+		Warn("Delta encoding requires protocol version 2")
+	}
+
+	Info("TTL sweep = %v", TTLSweep)
+	if TTLSweep < 0 || TTLSweep > 255 {
+		Fatal("TTL sweep must be between 0 (none) and 255")
+	}
+	if TTLSweep > 0 && Protocol < 2 {
+		Fatal("TTL sweeps require protocol version 2")
+	}
+	Info("MTU sweep = %v", MTUSweep)
+	if len(MTUSweep) > 0 {
+		if Protocol < 2 {
+			Fatal("MTU sweeps require protocol version 2")
 		}
-	case "udp6":
-		if Size < 0 || Size > 65527 {
-			Fatal("Size must be between 0 and 65527 for IPv6")
+		if Fragments {
+			Fatal("MTU sweeps require fragmentation to be disabled")
+		}
+		for _, size := range MTUSweep {
+			err = CheckSize(size, Transport)
+			if err != nil {
+				Fatal("MTU sweep: %v", err)
+			}
+			if size < 64 {
+				Fatal("MTU sweep sizes must be at least 64")
+			}
 		}
 	}
 
 	Info("LinkLocal = %v", LinkLocal)
 
+	Info("Stale = %v", Stale)
+	if Stale <= 0 {
+		Fatal("Stale must be greater than 0")
+	}
+
+	Info("History = %v", HistoryLength)
+	if HistoryLength < 10*time.Second || HistoryLength > 24*time.Hour {
+		Fatal("History must be between 10s and 24h")
+	}
+
 	// Compile regex engines
 	Info("Address regex = \"%s\"", AddressRegex)
-	AddressFilter, err = regexp2.Compile(AddressRegex, regexp2.IgnoreCase)
+	AddressFilter, err = CompileFilter(AddressRegex)
 	if err != nil {
-		Fatal("regexp2.Compile(%s): %v", AddressRegex, err)
+		Fatal("%v", err)
 	}
 	Info("Interface regex = \"%s\"", InterfaceRegex)
-	InterfaceFilter, err = regexp2.Compile(InterfaceRegex, regexp2.IgnoreCase)
+	InterfaceFilter, err = CompileFilter(InterfaceRegex)
 	if err != nil {
-		Fatal("regexp2.Compile(%s): %v", InterfaceRegex, err)
+		Fatal("%v", err)
+	}
+
+	Info("Role = %s", Role)
+	switch Role {
+	case "full":
+	case "beacon":
+		Warn("Beacons do not join the group, reports are only received from listeners by unicast")
+	case "listener":
+		Info("Unicast = %v", Unicast)
+		if !Unicast {
+			Warn("Listeners will not send any packets")
+		}
+	case "collector":
+		Info("Collectors listen for reports by unicast and do not send or receive multicast")
+	default:
+		Fatal("Role must be full, beacon, listener, or collector")
+	}
+
+	Info("CollectorPort = %v", CollectorPort)
+	if CollectorPort < 1 || CollectorPort > 65535 {
+		Fatal("CollectorPort must be between 1 and 65535")
+	}
+	for _, c := range CollectorAddrs {
+		network, addr := ParseCollector(c)
+		Info("Collector = %s://%s", network, addr)
+		if network != "udp" && network != "tcp" {
+			Fatal("Collector %s must use udp or tcp", c)
+		}
+	}
+
+	Info("Export = \"%s\"", Export)
+	if Export != "" {
+		_, err = ExportFormat(Export)
+		if err != nil {
+			Fatal("%v", err)
+		}
+	}
+
+	// "macy replay file" plays back a recording instead of sending and receiving, "macy pim file" and "macy igmp file" analyze the packets in a capture, and "macy mtrace source" traces the path from a source
+	if flags.NArg() > 0 {
+		if flags.NArg() != 2 {
+			Fatal("Unexpected arguments %v, commands are \"replay file\", \"pim file\", \"igmp file\", and \"mtrace source\"", flags.Args())
+		}
+		switch flags.Arg(0) {
+		case "replay":
+			Replay = flags.Arg(1)
+		case "pim":
+			PimFile = flags.Arg(1)
+		case "igmp":
+			IgmpFile = flags.Arg(1)
+		case "mtrace":
+			MtraceSource = flags.Arg(1)
+		default:
+			Fatal("Unknown command %s, commands are \"replay file\", \"pim file\", \"igmp file\", and \"mtrace source\"", flags.Arg(0))
+		}
+	}
+	Info("Replay = \"%s\"", Replay)
+	if Replay != "" {
+		Info("Replay speed = %v", ReplaySpeed)
+		if ReplaySpeed <= 0 {
+			Fatal("Replay speed must be greater than 0")
+		}
+		if RecordFile != "" {
+			Fatal("Recording is not possible during replay")
+		}
 	}
 
 	// Initialize zstd en/decoders
 	ZstdDecoder, _ = zstd.NewReader(nil)
-	if Size == 0 {
-		ZstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	ZstdEncoder, Padding = NewZstdEncoder(Size), Size
+
+	Info("Verbose = %v", Verbose)
+
+	Info("Log file = \"%s\"", LogFile)
+	if LogFile != "" {
+		Info("Log file size = %v MB, keep = %v", LogFileSize, LogFileKeep)
+		if LogFileSize < 0 {
+			Fatal("Log file size must be 0 (no rotation) or greater")
+		}
+		if LogFileKeep < 0 {
+			Fatal("Log file keep must be 0 or greater")
+		}
+	}
+	Info("Stderr = %v", LogStderr)
+	if LogStderr && IsTerminal(os.Stderr) {
+		Warn("Stderr is a terminal, so the log is only written to it when the TUI is not running, redirect it with 2>file")
+	}
+	Info("Syslog = \"%s\"", SyslogSocket)
+
+	Info("Record file = \"%s\"", RecordFile)
+	if RecordFile != "" {
+		Recording, err = OpenSession(RecordFile)
+		if err != nil {
+			Fatal("Record file %s: %v", RecordFile, err)
+		}
+	}
+	MakeSinks()
+
+	Info("PIM = %v", PimEnabled)
+	Info("Querier regex = \"%s\"", QuerierRegex)
+	if QuerierRegex != "" {
+		QuerierFilter, err = CompileFilter(QuerierRegex)
+		if err != nil {
+			Fatal("%v", err)
+		}
+		Info("Query version = %d", QueryVersion)
+		if QueryVersion != 2 && QueryVersion != 3 {
+			Fatal("Query version must be 2 or 3")
+		}
+		// The querier needs to hear other queriers to back off
+		IgmpEnabled = true
+	}
+	Info("IGMP = %v", IgmpEnabled)
+
+	Info("Mtrace router = \"%s\", hops = %d", MtraceRouter, MtraceHops)
+	if MtraceRouter != "" && net.ParseIP(MtraceRouter) == nil {
+		Fatal("Mtrace router %s is not an address", MtraceRouter)
+	}
+	if MtraceHops < 1 || MtraceHops > 255 {
+		Fatal("Mtrace hops must be between 1 and 255")
+	}
+	Info("Mtrace responder = %v", MtraceStub)
+
+	Info("Pcap file = \"%s\"", PcapFile)
+	if PcapFile != "" {
+		Capture, err = OpenPcap(PcapFile)
+		if err != nil {
+			Fatal("Pcap file %s: %v", PcapFile, err)
+		}
+	}
+
+	Info("API = \"%s\"", APIAddr)
+	if APIAddr != "" {
+		_, _, err = net.SplitHostPort(APIAddr)
+		if err != nil {
+			Fatal("API address %s: %v", APIAddr, err)
+		}
+	}
+}
+
+// ConfigArgs returns the options from the configuration file, if one is given on the command line, followed by the command-line options. Options given on the command line are left out of those from the file, so options that accumulate such as -c/--collectors are replaced rather than added to.
+func ConfigArgs() ([]string, error) {
+	cmd := pflag.NewFlagSet("macy", pflag.ContinueOnError)
+	cmd.SetOutput(io.Discard)
+	MirrorFlags(Flags, cmd)
+	err := cmd.Parse(os.Args[1:])
+	if err != nil {
+		// Parsing again with the real options reports the error
+		return os.Args[1:], nil
+	}
+	path := cmd.Lookup("config").Value.String()
+	if path == "" {
+		return os.Args[1:], nil
+	}
+
+	file, err := ReadConfigFile(path, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	for _, arg := range file {
+		name := strings.TrimPrefix(arg, "--")
+		if i := strings.Index(name, "="); i != -1 {
+			name = name[:i]
+		}
+		if f := cmd.Lookup(name); f != nil && f.Changed {
+			continue
+		}
+		args = append(args, arg)
+	}
+	return append(args, os.Args[1:]...), nil
+}
+
+// FlagText holds the text of an option without interpreting it, so a FlagSet that mirrors another parses the same arguments the same way
+type FlagText struct {
+	Text string
+	Kind string
+}
+
+func (f *FlagText) String() string {
+	return f.Text
+}
+
+func (f *FlagText) Set(s string) error {
+	f.Text = s
+	return nil
+}
+
+func (f *FlagText) Type() string {
+	return f.Kind
+}
+
+// MirrorFlags adds the options of src that are not already in dst to dst, keeping their text without changing the variables of src
+func MirrorFlags(src *pflag.FlagSet, dst *pflag.FlagSet) {
+	src.VisitAll(func(f *pflag.Flag) {
+		if dst.Lookup(f.Name) != nil {
+			return
+		}
+		dst.AddFlag(&pflag.Flag{
+			Name:        f.Name,
+			Shorthand:   f.Shorthand,
+			Usage:       f.Usage,
+			Value:       &FlagText{Text: f.DefValue, Kind: f.Value.Type()},
+			DefValue:    f.DefValue,
+			NoOptDefVal: f.NoOptDefVal,
+		})
+	})
+}
+
+// ReadConfigFile converts lines such as "ttl 4", "ttl = 4", or "linklocal" into command-line options, ignoring blank lines and comments. Shorthands are resolved to long names through flags.
+func ReadConfigFile(path string, flags *pflag.FlagSet) (args []string, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %v", err)
+	}
+	for n, line := range strings.Split(string(b), "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, value := line, ""
+		if i := strings.IndexAny(line, "= \t"); i != -1 {
+			name, value = line[:i], strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line[i:]), "="))
+		}
+		name = strings.TrimLeft(name, "-")
+		if name == "" || name == "config" {
+			return nil, fmt.Errorf("%s line %d: invalid option %q", path, n+1, line)
+		}
+		// Shorthands such as "t 4" are read as their long option
+		if len(name) == 1 {
+			f := flags.ShorthandLookup(name)
+			if f == nil {
+				return nil, fmt.Errorf("%s line %d: unknown option %q, use the long name of the option", path, n+1, name)
+			}
+			name = f.Name
+		}
+		if value == "" {
+			args = append(args, "--"+name)
+		} else {
+			args = append(args, "--"+name+"="+value)
+		}
+	}
+	return args, nil
+}
+
+// Reload reads the configuration file and command line again and applies the options that can change while running. It must only be called from the socket loop.
+func Reload() {
+	Info("Reloading configuration")
+	args, err := ConfigArgs()
+	if err != nil {
+		Warn("Reload: %v", err)
+		return
+	}
+	// Every option is parsed as at startup, but only the settings are applied
+	flags := pflag.NewFlagSet("macy", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var s Settings
+	SettingsFlags(flags, &s)
+	MirrorFlags(Flags, flags)
+	err = flags.Parse(args)
+	if err != nil {
+		Warn("Reload: %v", err)
+		return
+	}
+	ApplySettings(s)
+}
+
+func TransportFor(group net.IP) string {
+	if group.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+func CheckPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("Port must be between 1 and 65535")
+	}
+	return nil
+}
+
+func CheckMaxSize(size int, transport string) error {
+	switch transport {
+	case "udp4":
+		if size < 64 || size > 65507 {
+			return fmt.Errorf("MaxSize must be between 64 and 65507 for IPv4")
+		}
+	case "udp6":
+		if size < 64 || size > 65527 {
+			return fmt.Errorf("MaxSize must be between 64 and 65527 for IPv6")
+		}
+	}
+	return nil
+}
+
+func CheckTTL(ttl int) error {
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("TTL must be between 0 and 255")
+	}
+	return nil
+}
+
+func CheckRate(rate int) error {
+	if rate < 1 {
+		return fmt.Errorf("Rate must be greater than 0")
+	}
+	return nil
+}
+
+func CheckQoS(qos int) error {
+	if qos < 0 || qos > 63 {
+		return fmt.Errorf("QoS must be between 0 and 63")
+	}
+	return nil
+}
+
+func CheckSize(size int, transport string) error {
+	switch transport {
+	case "udp4":
+		if size < 0 || size > 65507 {
+			return fmt.Errorf("Size must be between 0 and 65507 for IPv4")
+		}
+	case "udp6":
+		if size < 0 || size > 65527 {
+			return fmt.Errorf("Size must be between 0 and 65527 for IPv6")
+		}
+	}
+	return nil
+}
+
+func CompileFilter(regex string) (*regexp2.Regexp, error) {
+	re, err := regexp2.Compile(regex, regexp2.IgnoreCase)
+	if err != nil {
+		return nil, fmt.Errorf("regexp2.Compile(%s): %v", regex, err)
+	}
+	// Patterns that backtrack catastrophically give up instead of hanging, which callers treat as no match
+	re.MatchTimeout = MatchTimeout
+	return re, nil
+}
+
+func NewZstdEncoder(size int) *zstd.Encoder {
+	var e *zstd.Encoder
+	if size == 0 {
+		e, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
 	} else {
-		ZstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderPadding(Size))
+		e, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderPadding(size))
 	}
+	return e
+}
 
-	Info("Verbose = %v", Verbose)
+// Settings are the options that can be changed while macy is running
+type Settings struct {
+	Group          net.IP
+	Port           int
+	TTL            int
+	Rate           int
+	QoS            int
+	Size           int
+	AddressRegex   string
+	InterfaceRegex string
+}
+
+func CurrentSettings() Settings {
+	Mutex.Lock()
+	s := Settings{
+		Group:          Group,
+		Port:           Port,
+		TTL:            TTL,
+		Rate:           Rate,
+		QoS:            QoS,
+		Size:           Size,
+		AddressRegex:   AddressRegex,
+		InterfaceRegex: InterfaceRegex,
+	}
+	Mutex.Unlock()
+	return s
+}
+
+// SettingsFlags defines the command-line options for settings, so the same options can be parsed again on reload
+func SettingsFlags(flags *pflag.FlagSet, s *Settings) {
+	flags.IPVarP(&s.Group, "group", "g", net.ParseIP("239.239.239.239"), "multicast group address")
+	flags.IntVarP(&s.Port, "port", "p", 23923, "UDP port number")
+	flags.IntVarP(&s.TTL, "ttl", "t", 1, "maximum hop count aka Time To Live")
+	flags.IntVarP(&s.Rate, "rate", "r", 2, "transmit rate in hertz")
+	flags.IntVarP(&s.QoS, "qos", "q", 0, "DiffServ CodePoint for QoS (default 0)")
+	flags.IntVarP(&s.Size, "size", "s", 0, "payload size before fragmentation (default 0)")
+	flags.StringVarP(&s.AddressRegex, "addresses", "a", "", "use addresses that match this regex (default \"\")")
+	flags.StringVarP(&s.InterfaceRegex, "interfaces", "i", "", "use interfaces that match this regex (default \"\")")
+}
+
+func (s Settings) Validate() error {
+	if !s.Group.IsMulticast() {
+		return fmt.Errorf("%s is not a multicast group address", s.Group)
+	}
+	transport := TransportFor(s.Group)
+	for _, err := range []error{CheckPort(s.Port), CheckTTL(s.TTL), CheckRate(s.Rate), CheckQoS(s.QoS), CheckSize(s.Size, transport), CheckMaxSize(MaxSize, transport)} {
+		if err != nil {
+			return err
+		}
+	}
+	// Sweep sizes that fit one family may not fit the other
+	for _, size := range MTUSweep {
+		err := CheckSize(size, transport)
+		if err != nil {
+			return fmt.Errorf("MTU sweep: %v", err)
+		}
+	}
+	for _, regex := range []string{s.AddressRegex, s.InterfaceRegex} {
+		_, err := CompileFilter(regex)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplySettings changes the running configuration and recreates the affected sockets. It must only be called from the socket loop.
+func ApplySettings(s Settings) {
+	err := s.Validate()
+	if err != nil {
+		Warn("Settings not applied: %v", err)
+		return
+	}
+
+	old := CurrentSettings()
+	rebuild := false
+	rejoin := false
+	Mutex.Lock()
+	if !s.Group.Equal(old.Group) {
+		LogChange("Group", old.Group, s.Group)
+		Group = s.Group
+		if TransportFor(Group) != Transport {
+			Transport = TransportFor(Group)
+			LogChange("Transport", TransportFor(old.Group), Transport)
+			rebuild = true
+		}
+		rejoin = true
+	}
+	if s.Port != old.Port {
+		LogChange("Port", old.Port, s.Port)
+		Port = s.Port
+		rejoin = true
+	}
+	if s.TTL != old.TTL {
+		LogChange("TTL", old.TTL, s.TTL)
+		TTL = s.TTL
+		rebuild = true
+	}
+	if s.QoS != old.QoS {
+		LogChange("QoS", old.QoS, s.QoS)
+		QoS = s.QoS
+		rebuild = true
+	}
+	if s.Rate != old.Rate {
+		LogChange("Rate", old.Rate, s.Rate)
+		Rate = s.Rate
+	}
+	if s.Size != old.Size {
+		LogChange("Size", old.Size, s.Size)
+		Size = s.Size
+		ZstdEncoder, Padding = NewZstdEncoder(Size), Size
+	}
+	if s.AddressRegex != old.AddressRegex {
+		LogChange("Address regex", old.AddressRegex, s.AddressRegex)
+		AddressRegex = s.AddressRegex
+		AddressFilter, _ = CompileFilter(AddressRegex)
+	}
+	if s.InterfaceRegex != old.InterfaceRegex {
+		LogChange("Interface regex", old.InterfaceRegex, s.InterfaceRegex)
+		InterfaceRegex = s.InterfaceRegex
+		InterfaceFilter, _ = CompileFilter(InterfaceRegex)
+	}
+	Mutex.Unlock()
+
+	// The Receiver leaves the old group and is recreated for the new group and port on the next pass of the socket loop
+	if rejoin && Receiver != nil {
+		for _, iface := range Receiver.Joined {
+			err := Receiver.LeaveGroup(iface, old.Group)
+			if err != nil {
+				Debug("Receiver: LeaveGroup(%s, %s): %v", iface.Name, old.Group, err)
+			}
+		}
+		Event(LevelInfo, Attrs{"event": "receiver_delete", "group": old.Group.String(), "reason": "settings changed"}, "Deleting Receiver for address %s port %d to apply new settings", old.Group, old.Port)
+		Receiver.Close()
+		Receiver = nil
+	}
+
+	// Raw sockets, the Publisher, and connections to collectors are recreated in the family of the new transport
+	if TransportFor(s.Group) != TransportFor(old.Group) {
+		CheckRawSockets(true)
+		if Publisher != nil {
+			Event(LevelInfo, Attrs{"event": "publisher_delete", "reason": "settings changed"}, "Deleting Publisher to apply new settings")
+			Publisher.Close()
+			Mutex.Lock()
+			Publisher = nil
+			Mutex.Unlock()
+		}
+		Mutex.Lock()
+		for key, c := range Collectors {
+			Event(LevelInfo, Attrs{"event": "collector_delete", "collector": key, "reason": "settings changed"}, "Deleting connection to collector %s to apply new settings", key)
+			close(c.Queue)
+			delete(Collectors, key)
+		}
+		Mutex.Unlock()
+	}
+
+	// Senders are recreated on the next pass of the socket loop with the new TTL, QoS, and transport
+	if rebuild {
+		if TTL <= 1 {
+			Warn("Reports will not be forwarded beyond the attached subnets")
+		}
+		for key, sock := range Senders {
+			Event(LevelInfo, Attrs{"event": "sender_delete", "interface": sock.Iface.Name, "address": sock.IP.String(), "reason": "settings changed"}, "Deleting %s to apply new settings", key)
+			sock.Close()
+			Mutex.Lock()
+			delete(Senders, key)
+			Mutex.Unlock()
+		}
+	}
+}
+
+func LogChange(name string, old any, new any) {
+	Event(LevelInfo, Attrs{"event": "setting_change", "setting": name, "old": old, "new": new}, "%s changed from %v to %v", name, old, new)
 }
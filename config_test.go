@@ -0,0 +1,57 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/pflag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	flags := pflag.NewFlagSet("macy", pflag.ContinueOnError)
+	flags.IntP("ttl", "t", 1, "")
+	flags.BoolP("linklocal", "l", false, "")
+	flags.StringSlice("collectors", nil, "")
+	for _, c := range []struct {
+		file string
+		want []string
+		err  string
+	}{
+		{"ttl 4\n# comment\n\nlinklocal\ncollectors = a,b # trailing\n", []string{"--ttl=4", "--linklocal", "--collectors=a,b"}, ""},
+		{"t 4\n-l\n", []string{"--ttl=4", "--linklocal"}, ""},
+		{"x 4\n", nil, `line 1: unknown option "x", use the long name of the option`},
+		{"config other\n", nil, "line 1: invalid option"},
+	} {
+		path := filepath.Join(t.TempDir(), "macy.conf")
+		err := os.WriteFile(path, []byte(c.file), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := ReadConfigFile(path, flags)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("ReadConfigFile(%q) error = %v, want %q", c.file, err, c.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(args, c.want) {
+			t.Errorf("ReadConfigFile(%q) = %q, %v, want %q", c.file, args, err, c.want)
+		}
+	}
+}
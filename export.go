@@ -0,0 +1,220 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshot is the Reports table with raw values, and the configuration and filters it was taken with
+type Snapshot struct {
+	Time         time.Time     `json:"time"`
+	Host         string        `json:"host"`
+	Group        string        `json:"group"`
+	Port         int           `json:"port"`
+	TTL          int           `json:"ttl"`
+	QoS          int           `json:"qos"`
+	Rate         int           `json:"rate"`
+	Stale        float64       `json:"stale_seconds"`
+	IPSearch     string        `json:"ip_search"`
+	HostSearch   string        `json:"host_search"`
+	ProblemsOnly bool          `json:"problems_only"`
+	Hosts        []string      `json:"hosts"`
+	Rows         []SnapshotRow `json:"rows"`
+}
+
+// SnapshotRow holds the seconds since each host last heard an IP, or nil if it never has
+type SnapshotRow struct {
+	IP    string     `json:"ip"`
+	Owner string     `json:"owner,omitempty"`
+	Local bool       `json:"local"`
+	Ages  []*float64 `json:"ages"`
+}
+
+// ExportFormat returns the format of an export file from its extension
+func ExportFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return "csv", nil
+	case ".json":
+		return "json", nil
+	case ".md", ".markdown":
+		return "markdown", nil
+	}
+	return "", fmt.Errorf("%s: export file must end in .csv, .json, or .md", path)
+}
+
+// ExportPath returns the file written when X is pressed, which has the time inserted before the extension so earlier snapshots are kept
+func ExportPath(t time.Time) string {
+	path := Export
+	if path == "" {
+		path = "macy.csv"
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.Format("20060102-150405") + ext
+}
+
+// TakeSnapshot copies the Reports table as currently filtered and sorted, recording the filters so a partial table says so
+func TakeSnapshot() Snapshot {
+	Mutex.Lock()
+	now := Now()
+	localIPs := make(map[string]bool)
+	for _, s := range Senders {
+		localIPs[s.IP.String()] = true
+	}
+	ips, hosts, ages, owner := ReportsMatrix(localIPs, now)
+	z := Snapshot{
+		Time:  now,
+		Host:  Host,
+		Group: Group.String(),
+		Port:  Port,
+		TTL:   TTL,
+		QoS:   QoS,
+		Rate:  Rate,
+		Stale: Stale.Seconds(),
+		Hosts: hosts,
+
+		ProblemsOnly: ProblemsOnly,
+	}
+	if IPSearchRe != nil {
+		z.IPSearch = IPSearchRe.String()
+	}
+	if HostSearchRe != nil {
+		z.HostSearch = HostSearchRe.String()
+	}
+	for _, ip := range ips {
+		row := SnapshotRow{IP: ip, Owner: owner[ip], Local: localIPs[ip]}
+		for _, host := range hosts {
+			var age *float64
+			if d := ages[ip][host]; d != 0 {
+				seconds := d.Round(time.Millisecond).Seconds()
+				age = &seconds
+			}
+			row.Ages = append(row.Ages, age)
+		}
+		z.Rows = append(z.Rows, row)
+	}
+	Mutex.Unlock()
+	return z
+}
+
+// WriteSnapshot writes a snapshot of the Reports table to path in the format given by its extension
+func WriteSnapshot(path string) error {
+	format, err := ExportFormat(path)
+	if err != nil {
+		return err
+	}
+	snapshot := TakeSnapshot()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		// The metadata is one comment line, so readers that skip it see a table with the same columns on every row
+		var fields []string
+		for _, meta := range snapshot.Metadata() {
+			value := meta[1]
+			if value == "" || strings.ContainsAny(value, " \t\r\n\"") {
+				value = strconv.Quote(value)
+			}
+			fields = append(fields, meta[0]+"="+value)
+		}
+		_, err = fmt.Fprintf(f, "# %s\n", strings.Join(fields, " "))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w := csv.NewWriter(f)
+		w.Write(append([]string{"ip"}, snapshot.Hosts...))
+		for _, row := range snapshot.Rows {
+			w.Write(append([]string{row.IP}, row.Cells()...))
+		}
+		w.Flush()
+		err = w.Error()
+	case "json":
+		e := json.NewEncoder(f)
+		e.SetIndent("", "  ")
+		err = e.Encode(snapshot)
+	case "markdown":
+		var b strings.Builder
+		for _, meta := range snapshot.Metadata() {
+			fmt.Fprintf(&b, "- %s: %s\n", meta[0], meta[1])
+		}
+		b.WriteString("\n| IP |")
+		for _, host := range snapshot.Hosts {
+			fmt.Fprintf(&b, " %s |", host)
+		}
+		b.WriteString("\n|:---|")
+		for range snapshot.Hosts {
+			b.WriteString("---:|")
+		}
+		b.WriteString("\n")
+		for _, row := range snapshot.Rows {
+			fmt.Fprintf(&b, "| %s |", row.IP)
+			for _, cell := range row.Cells() {
+				fmt.Fprintf(&b, " %s |", cell)
+			}
+			b.WriteString("\n")
+		}
+		_, err = f.WriteString(b.String())
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	Event(LevelInfo, Attrs{"event": "export", "file": path, "format": format, "rows": len(snapshot.Rows), "columns": len(snapshot.Hosts)}, "Exported %d IPs heard by %d hosts to %s", len(snapshot.Rows), len(snapshot.Hosts), path)
+	return nil
+}
+
+// Metadata returns the names and values that describe a snapshot, in the order they are written
+func (s Snapshot) Metadata() [][2]string {
+	return [][2]string{
+		{"time", s.Time.Format(time.RFC3339)},
+		{"host", s.Host},
+		{"group", s.Group},
+		{"port", strconv.Itoa(s.Port)},
+		{"ttl", strconv.Itoa(s.TTL)},
+		{"qos", strconv.Itoa(s.QoS)},
+		{"rate", strconv.Itoa(s.Rate)},
+		{"stale", strconv.FormatFloat(s.Stale, 'f', -1, 64)},
+		{"ip_search", s.IPSearch},
+		{"host_search", s.HostSearch},
+		{"problems_only", strconv.FormatBool(s.ProblemsOnly)},
+	}
+}
+
+// Cells returns the ages of a row in seconds, empty where the IP has never been heard
+func (r SnapshotRow) Cells() (z []string) {
+	for _, age := range r.Ages {
+		if age == nil {
+			z = append(z, "")
+		} else {
+			z = append(z, strconv.FormatFloat(*age, 'f', 3, 64))
+		}
+	}
+	return z
+}
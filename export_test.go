@@ -0,0 +1,63 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSnapshotCSV(t *testing.T) {
+	defer func() {
+		IPSearchRe, ProblemsOnly = nil, false
+		HeardDb = make(map[string]map[string]time.Duration)
+		HeardHosts = make(map[string]time.Time)
+	}()
+	HeardHosts = map[string]time.Time{"host1": Now()}
+	HeardDb = map[string]map[string]time.Duration{"host1": {"10.0.0.1": time.Second, "10.0.0.2": 2 * time.Second, "192.0.2.1": time.Second}}
+	IPSearchRe, _ = CompileFilter(`^10\.`)
+	ProblemsOnly = false
+
+	path := filepath.Join(t.TempDir(), "macy.csv")
+	err := WriteSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := strings.SplitN(string(b), "\n", 2)[0]
+	for _, want := range []string{"# time=", `ip_search=^10\.`, `host_search=""`, "problems_only=false"} {
+		if !strings.Contains(first, want) {
+			t.Errorf("metadata line %q does not contain %q", first, want)
+		}
+	}
+
+	// Every row has the columns of the header
+	r := csv.NewReader(strings.NewReader(string(b)))
+	r.Comment = '#'
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0][0] != "ip" || rows[1][0] != "10.0.0.1" || rows[2][0] != "10.0.0.2" {
+		t.Errorf("rows = %q, want the header and the two IPs matching the search", rows)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.rocketnine.space/tslocum/cview"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	GraphWidth = 60
+	Sparks     = " ▁▂▃▄▅▆▇█"
+
+	// Intervals between reports kept to find the rate each source sends at
+	ArrivalIntervals = 15
+)
+
+var (
+	Graphs       = cview.NewTable()
+	Arrivals     = make(map[string]*History)
+	GraphsByHost bool
+)
+
+// History is a ring buffer of the number of reports received from a source during each second
+type History struct {
+	Counts []float64
+	Last   int64
+
+	// When a datagram and the first part of a report last arrived, and the recent intervals between reports
+	Seen      time.Time
+	Started   time.Time
+	Intervals []time.Duration
+}
+
+func NewHistory() *History {
+	return &History{
+		Counts: make([]float64, int(HistoryLength/time.Second)+1),
+		Last:   Now().Unix(),
+	}
+}
+
+// Advance zeroes the slots for seconds that passed without any arrivals
+func (h *History) Advance(sec int64) {
+	if sec-h.Last >= int64(len(h.Counts)) {
+		for i := range h.Counts {
+			h.Counts[i] = 0
+		}
+	} else {
+		for s := h.Last + 1; s <= sec; s++ {
+			h.Counts[s%int64(len(h.Counts))] = 0
+		}
+	}
+	if sec > h.Last {
+		h.Last = sec
+	}
+}
+
+func (h *History) Add(t time.Time, n float64) {
+	sec := t.Unix()
+	h.Advance(sec)
+	h.Counts[sec%int64(len(h.Counts))] += n
+}
+
+// Seconds returns the counts for the complete seconds before sec, oldest first
+func (h *History) Seconds(sec int64) []float64 {
+	h.Advance(sec)
+	z := make([]float64, 0, len(h.Counts)-1)
+	for s := sec - int64(len(h.Counts)) + 1; s < sec; s++ {
+		z = append(z, h.Counts[s%int64(len(h.Counts))])
+	}
+	return z
+}
+
+// Rate returns the reports per second the source sends, from the median of the recent intervals since sources may use a different --rate, or the local rate until enough have been seen
+func (h *History) Rate() float64 {
+	if len(h.Intervals) < 3 {
+		return float64(Rate)
+	}
+	intervals := append([]time.Duration{}, h.Intervals...)
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+
+	// Rates are whole reports per second, so rounding removes the jitter
+	rate := math.Round(float64(time.Second) / float64(intervals[len(intervals)/2]))
+	if rate < 1 {
+		rate = 1
+	}
+	return rate
+}
+
+// RecordArrival counts a received datagram, with each part of a multi-part report counting as a fraction of a report. Mutex must be held.
+func RecordArrival(ip string, r *Report, t time.Time) {
+	h := Arrivals[ip]
+	if h == nil {
+		h = NewHistory()
+		Arrivals[ip] = h
+	}
+	h.Seen = t
+	if r.Part == 0 {
+		if d := t.Sub(h.Started); !h.Started.IsZero() && d > 0 {
+			h.Intervals = append(h.Intervals, d)
+			if len(h.Intervals) > ArrivalIntervals {
+				h.Intervals = h.Intervals[1:]
+			}
+		}
+		h.Started = t
+	}
+	if r.Total > 1 {
+		h.Add(t, 1/float64(r.Total))
+	} else {
+		h.Add(t, 1)
+	}
+}
+
+// Sparkline draws values scaled to max, one rune per value
+func Sparkline(values []float64, max float64) string {
+	runes := []rune(Sparks)
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > 0 && v > 0 {
+			i = int(v/max*float64(len(runes)-1) + 0.5)
+			if i < 1 {
+				i = 1
+			}
+			if i > len(runes)-1 {
+				i = len(runes) - 1
+			}
+		}
+		b.WriteRune(runes[i])
+	}
+	return b.String()
+}
+
+func UpdateGraphs() {
+	// Lock access to maps
+	Mutex.Lock()
+	Graphs.Clear()
+
+	t := Now()
+	now := t.Unix()
+	owner := make(map[string]string)
+	for host, addrs := range HostAddrs() {
+		for _, ip := range addrs {
+			owner[ip] = host
+		}
+	}
+
+	// Sum the counts of each source, and the number of IPs expected to contribute to it
+	sums := make(map[string][]float64)
+	expected := make(map[string]float64)
+	for ip, h := range Arrivals {
+		// Sources that stopped sending before the start of the graphs are forgotten
+		if t.Sub(h.Seen) > HistoryLength {
+			delete(Arrivals, ip)
+			continue
+		}
+		source := ip
+		if GraphsByHost {
+			source = owner[ip]
+			if source == "" {
+				source = ip
+			}
+		}
+		seconds := h.Seconds(now)
+		if sums[source] == nil {
+			sums[source] = make([]float64, len(seconds))
+		}
+		for i, v := range seconds {
+			sums[source][i] += v
+		}
+		expected[source] += h.Rate()
+	}
+	var sources []string
+	for source, seconds := range sums {
+		var total float64
+		for _, v := range seconds {
+			total += v
+		}
+		if total == 0 {
+			continue
+		}
+		sources = append(sources, source)
+	}
+	if GraphsByHost {
+		sort.Strings(sources)
+	} else {
+		sort.SliceStable(sources, func(i, j int) bool { return IPLess(sources[i], sources[j]) })
+	}
+
+	// Each column of a graph covers one bucket of seconds, the rate is averaged and the loss is the worst second in the bucket
+	bucket := (int(HistoryLength/time.Second) + GraphWidth - 1) / GraphWidth
+	if bucket < 1 {
+		bucket = 1
+	}
+	by := "IP"
+	if GraphsByHost {
+		by = "host"
+	}
+	Graphs.SetTitle(fmt.Sprintf(" By %s (B) | %v per column ", by, time.Duration(bucket)*time.Second))
+	for c, title := range []string{"Source", "Reports/s", "Now", "Loss", "Worst"} {
+		cell := cview.NewTableCell(title)
+		cell.SetTextColor(tcell.ColorGrey)
+		Graphs.SetCell(0, c, cell)
+	}
+	for r, source := range sources {
+		seconds := sums[source]
+		var rates, losses []float64
+		var max, worst float64
+		for i := len(seconds) % bucket; i+bucket <= len(seconds); i += bucket {
+			var sum, loss float64
+			for _, v := range seconds[i : i+bucket] {
+				sum += v
+				if l := 1 - v/expected[source]; l > loss {
+					loss = l
+				}
+			}
+			rates = append(rates, sum/float64(bucket))
+			losses = append(losses, loss)
+			if sum/float64(bucket) > max {
+				max = sum / float64(bucket)
+			}
+			if loss > worst {
+				worst = loss
+			}
+		}
+		if max < expected[source] {
+			max = expected[source]
+		}
+		current := seconds[len(seconds)-1]
+
+		cell := cview.NewTableCell(source)
+		if source == Host || (!GraphsByHost && owner[source] == Host) {
+			cell.SetTextColor(tcell.ColorAqua)
+		}
+		Graphs.SetCell(r+1, 0, cell)
+		cell = cview.NewTableCell(Sparkline(rates, max))
+		cell.SetTextColor(tcell.ColorGreen)
+		Graphs.SetCell(r+1, 1, cell)
+		cell = cview.NewTableCell(fmt.Sprintf("%.1f/s", current))
+		cell.SetAlign(cview.AlignRight)
+		Graphs.SetCell(r+1, 2, cell)
+		cell = cview.NewTableCell(Sparkline(losses, 1))
+		cell.SetTextColor(tcell.ColorRed)
+		Graphs.SetCell(r+1, 3, cell)
+		cell = cview.NewTableCell(fmt.Sprintf("%.0f%%", worst*100))
+		cell.SetAlign(cview.AlignRight)
+		if worst > 0 {
+			cell.SetTextColor(tcell.ColorRed)
+		}
+		Graphs.SetCell(r+1, 4, cell)
+	}
+
+	// Unlock access to maps
+	Mutex.Unlock()
+}
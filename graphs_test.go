@@ -0,0 +1,45 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryRate(t *testing.T) {
+	defer func(rate int, history time.Duration) { Rate, HistoryLength = rate, history }(Rate, HistoryLength)
+	Rate, HistoryLength = 2, time.Minute
+	t0 := time.Unix(1700000000, 0)
+	for _, c := range []struct {
+		name    string
+		reports []time.Duration
+		want    float64
+	}{
+		{"local rate until there are intervals", []time.Duration{0, 200 * time.Millisecond}, 2},
+		{"faster peer with jitter", []time.Duration{0, 190 * time.Millisecond, 410 * time.Millisecond, 600 * time.Millisecond, 805 * time.Millisecond, 990 * time.Millisecond}, 5},
+		{"slower peer with a lost report", []time.Duration{0, time.Second, 3 * time.Second, 4 * time.Second, 5 * time.Second}, 1},
+	} {
+		h := NewHistory()
+		for _, d := range c.reports {
+			Arrivals = map[string]*History{"10.0.0.1": h}
+			RecordArrival("10.0.0.1", &Report{Total: 1}, t0.Add(d))
+		}
+		if got := h.Rate(); got != c.want {
+			t.Errorf("%s: Rate() = %v, want %v", c.name, got, c.want)
+		}
+	}
+	Arrivals = make(map[string]*History)
+}
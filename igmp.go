@@ -0,0 +1,520 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"code.rocketnine.space/tslocum/cview"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IGMP types from RFC 3376 and MLD types from RFC 3810
+const (
+	IgmpQuery    = 0x11
+	IgmpReport1  = 0x12
+	IgmpReport2  = 0x16
+	IgmpLeave    = 0x17
+	IgmpReport3  = 0x22
+	MldQuery     = 130
+	MldReport1   = 131
+	MldDone      = 132
+	MldReport2   = 143
+	IgmpProtocol = 2
+	MldProtocol  = 58
+
+	// Defaults for the Other Querier Present Interval, after which a querier is gone
+	IgmpQueryInterval = 125 * time.Second
+	IgmpRobustness    = 2
+)
+
+var (
+	IgmpAllRouters4 = []net.IP{net.ParseIP("224.0.0.2"), net.ParseIP("224.0.0.22")}
+	IgmpAllRouters6 = []net.IP{net.ParseIP("ff02::2"), net.ParseIP("ff02::16")}
+
+	// Data, guarded by Mutex
+	IgmpQueriers = make(map[string]*IgmpQuerier)
+	IgmpMembers  = make(map[string]*IgmpMember)
+	IgmpSince    = make(map[string]time.Time)
+	IgmpRecent   []string
+
+	Queriers = cview.NewTextView()
+)
+
+// IgmpMessage is a decoded IGMP or MLD message
+type IgmpMessage struct {
+	Type      int
+	Version   string
+	Time      time.Time
+	Interface string
+	Src       net.IP
+	Dst       net.IP
+
+	// Queries, where Group is also used by version 1 and 2 reports, leaves, and dones
+	Group    net.IP
+	MaxResp  time.Duration
+	QRV      int
+	QQI      time.Duration
+	Suppress bool
+	Sources  int
+
+	// Version 3 and MLDv2 reports
+	Records []IgmpRecord
+}
+
+// IgmpRecord is a group record of a version 3 or MLDv2 report
+type IgmpRecord struct {
+	Type    int
+	Group   net.IP
+	Sources []net.IP
+}
+
+// IgmpQuerier is a router heard sending general queries on an interface
+type IgmpQuerier struct {
+	Interface string
+	Addr      net.IP
+	Version   string
+	QRV       int
+	QQI       time.Duration
+	MaxResp   time.Duration
+	Interval  time.Duration
+	First     time.Time
+	Last      time.Time
+	Queries   int
+}
+
+// IgmpMember is a host heard reporting membership of a group on an interface
+type IgmpMember struct {
+	Interface string
+	Group     net.IP
+	Host      net.IP
+	Version   string
+	Mode      string
+	Last      time.Time
+	Left      bool
+}
+
+// IgmpCode decodes the floating point codes of IGMPv3 and MLDv2
+func IgmpCode(code int, mantissaBits int, expBits int) int {
+	if code < 1<<(mantissaBits+expBits) {
+		return code
+	}
+	mant := code & (1<<mantissaBits - 1)
+	exp := code >> mantissaBits & (1<<expBits - 1)
+	return (mant | 1<<mantissaBits) << (exp + 3)
+}
+
+// DecodeIgmp decodes an IGMP message, or an MLD message if protocol is MldProtocol, returning nil for other ICMPv6 messages
+func DecodeIgmp(protocol int, b []byte) (*IgmpMessage, error) {
+	if protocol == MldProtocol {
+		return DecodeMld(b)
+	}
+	if len(b) < 8 {
+		return nil, errors.New("IGMP message is too short")
+	}
+	m := &IgmpMessage{Type: int(b[0])}
+	switch m.Type {
+	case IgmpQuery:
+		m.Group = net.IP(append([]byte{}, b[4:8]...))
+		switch {
+		case len(b) >= 12:
+			m.Version = "IGMPv3"
+			m.MaxResp = time.Duration(IgmpCode(int(b[1]), 4, 3)) * time.Second / 10
+			m.Suppress, m.QRV = b[8]&0x08 != 0, int(b[8]&0x07)
+			m.QQI = time.Duration(IgmpCode(int(b[9]), 4, 3)) * time.Second
+			m.Sources = int(binary.BigEndian.Uint16(b[10:]))
+		case b[1] == 0:
+			m.Version = "IGMPv1"
+			m.MaxResp = 10 * time.Second
+		default:
+			m.Version = "IGMPv2"
+			m.MaxResp = time.Duration(b[1]) * time.Second / 10
+		}
+	case IgmpReport1:
+		m.Version, m.Group = "IGMPv1", net.IP(append([]byte{}, b[4:8]...))
+	case IgmpReport2, IgmpLeave:
+		m.Version, m.Group = "IGMPv2", net.IP(append([]byte{}, b[4:8]...))
+	case IgmpReport3:
+		m.Version = "IGMPv3"
+		records, err := IgmpRecords(b[6:], int(binary.BigEndian.Uint16(b[6:])), net.IPv4len)
+		if err != nil {
+			return nil, err
+		}
+		m.Records = records
+	default:
+		return nil, nil
+	}
+	return m, nil
+}
+
+func DecodeMld(b []byte) (*IgmpMessage, error) {
+	if len(b) < 8 {
+		return nil, errors.New("MLD message is too short")
+	}
+	m := &IgmpMessage{Type: int(b[0])}
+	switch m.Type {
+	case MldQuery, MldReport1, MldDone:
+		if len(b) < 24 {
+			return nil, errors.New("MLD message is too short")
+		}
+		m.Group = net.IP(append([]byte{}, b[8:24]...))
+		m.Version = "MLDv1"
+		if m.Type == MldQuery {
+			m.MaxResp = time.Duration(binary.BigEndian.Uint16(b[4:])) * time.Millisecond
+			if len(b) >= 28 {
+				m.Version = "MLDv2"
+				m.MaxResp = time.Duration(IgmpCode(int(binary.BigEndian.Uint16(b[4:])), 12, 3)) * time.Millisecond
+				m.Suppress, m.QRV = b[24]&0x08 != 0, int(b[24]&0x07)
+				m.QQI = time.Duration(IgmpCode(int(b[25]), 4, 3)) * time.Second
+				m.Sources = int(binary.BigEndian.Uint16(b[26:]))
+			}
+		}
+	case MldReport2:
+		m.Version = "MLDv2"
+		records, err := IgmpRecords(b[6:], int(binary.BigEndian.Uint16(b[6:])), net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		m.Records = records
+	default:
+		return nil, nil
+	}
+	return m, nil
+}
+
+// IgmpRecords decodes the group records of a report, where b starts at the number of records
+func IgmpRecords(b []byte, n int, addrLen int) (z []IgmpRecord, err error) {
+	// Each record starts with the type, aux length, number of sources and group
+	header := 4 + addrLen
+	b = b[2:]
+	for i := 0; i < n; i++ {
+		if len(b) < header {
+			return nil, errors.New("group record is truncated")
+		}
+		r := IgmpRecord{Type: int(b[0]), Group: net.IP(append([]byte{}, b[4:4+addrLen]...))}
+		aux, sources := int(b[1])*4, int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < header+sources*addrLen+aux {
+			return nil, errors.New("group record is truncated")
+		}
+		for j := 0; j < sources; j++ {
+			r.Sources = append(r.Sources, net.IP(append([]byte{}, b[header+j*addrLen:header+(j+1)*addrLen]...)))
+		}
+		z = append(z, r)
+		b = b[header+sources*addrLen+aux:]
+	}
+	return z, nil
+}
+
+// StoreIgmp updates the queriers and members with a received message. Mutex must be held.
+func StoreIgmp(m *IgmpMessage) {
+	if IgmpSince[m.Interface].IsZero() {
+		IgmpSince[m.Interface] = m.Time
+	}
+	recent := ""
+	switch m.Type {
+	case IgmpQuery, MldQuery:
+		// Group-specific queries follow leaves, only general queries show the querier
+		if !m.Group.IsUnspecified() {
+			recent = fmt.Sprintf("%s group query for %s from %s on %s", m.Version, m.Group, m.Src, m.Interface)
+			break
+		}
+		key := m.Interface + " " + m.Src.String()
+		q := IgmpQueriers[key]
+		if q == nil {
+			q = &IgmpQuerier{Interface: m.Interface, Addr: m.Src, First: m.Time}
+			IgmpQueriers[key] = q
+			recent = fmt.Sprintf("New %s querier %s on %s", m.Version, m.Src, m.Interface)
+		} else {
+			q.Interval = m.Time.Sub(q.Last)
+		}
+		q.Version, q.QRV, q.QQI, q.MaxResp, q.Last = m.Version, m.QRV, m.QQI, m.MaxResp, m.Time
+		q.Queries++
+	case IgmpReport1, IgmpReport2, MldReport1:
+		StoreMember(m, m.Group, "exclude", false)
+	case IgmpLeave, MldDone:
+		StoreMember(m, m.Group, "leave", true)
+		recent = fmt.Sprintf("%s leave for %s from %s on %s", m.Version, m.Group, m.Src, m.Interface)
+	case IgmpReport3, MldReport2:
+		for _, r := range m.Records {
+			// Record types 1 and 3 are include mode, and an include record without sources is a leave.
+			// Types 5 and 6 allow and block sources, which only changes an include mode membership.
+			switch r.Type {
+			case 1, 3, 5, 6:
+				StoreMember(m, r.Group, "include", len(r.Sources) == 0 && (r.Type == 1 || r.Type == 3))
+			default:
+				StoreMember(m, r.Group, "exclude", false)
+			}
+		}
+	}
+
+	if recent != "" {
+		IgmpRecent = append(IgmpRecent, m.Time.Format("01-02 15:04:05")+" "+recent)
+		if len(IgmpRecent) > PimRecentMax {
+			IgmpRecent = IgmpRecent[len(IgmpRecent)-PimRecentMax:]
+		}
+	}
+}
+
+// StoreMember records a host's membership of a group. Mutex must be held.
+func StoreMember(m *IgmpMessage, group net.IP, mode string, left bool) {
+	key := m.Interface + " " + group.String() + " " + m.Src.String()
+	member := IgmpMembers[key]
+	if member == nil {
+		member = &IgmpMember{Interface: m.Interface, Group: group, Host: m.Src}
+		IgmpMembers[key] = member
+	}
+	member.Version, member.Mode, member.Last, member.Left = m.Version, mode, m.Time, left
+}
+
+// OtherQuerierPresent returns how long a querier is remembered without hearing another general query
+func (q *IgmpQuerier) OtherQuerierPresent() time.Duration {
+	qrv, qqi := q.QRV, q.QQI
+	if qrv == 0 {
+		qrv = IgmpRobustness
+	}
+	if qqi == 0 {
+		qqi = IgmpQueryInterval
+	}
+	return time.Duration(qrv)*qqi + q.MaxResp/2
+}
+
+// ElectedQueriers returns the querier on each interface, which is the live querier with the lowest address. Mutex must be held.
+func ElectedQueriers(now time.Time) map[string]*IgmpQuerier {
+	z := make(map[string]*IgmpQuerier)
+	for _, q := range IgmpQueriers {
+		if now.Sub(q.Last) > q.OtherQuerierPresent() {
+			continue
+		}
+		if e := z[q.Interface]; e == nil || bytes.Compare(q.Addr.To16(), e.Addr.To16()) < 0 {
+			z[q.Interface] = q
+		}
+	}
+	return z
+}
+
+// IgmpInterfaces returns every interface that IGMP or MLD has been heard on. Mutex must be held.
+func IgmpInterfaces() (z []string) {
+	for name := range IgmpSince {
+		z = append(z, name)
+	}
+	sort.Strings(z)
+	return z
+}
+
+// IgmpProblems returns the problems that cause multicast to stop after a few minutes on snooping switches. Mutex must be held.
+func IgmpProblems(now time.Time) (z []string) {
+	elected := ElectedQueriers(now)
+	for _, name := range IgmpInterfaces() {
+		q := elected[name]
+		if q == nil {
+			// Measure from the last general query, or from when listening started if none was heard
+			since := IgmpSince[name]
+			for _, other := range IgmpQueriers {
+				if other.Interface == name && other.Last.After(since) {
+					since = other.Last
+				}
+			}
+			if now.Sub(since) > IgmpRobustness*IgmpQueryInterval+5*time.Second {
+				z = append(z, fmt.Sprintf("No querier on %s for %s, snooping switches will age out memberships", name, now.Sub(since).Round(time.Second)))
+			}
+			continue
+		}
+		if q.Interval > 0 && q.QQI > 0 && q.Interval > q.QQI*3/2 {
+			z = append(z, fmt.Sprintf("Querier %s on %s sends general queries every %s but advertises %s", q.Addr, name, q.Interval.Round(time.Second), q.QQI))
+		}
+
+		// Queriers and hosts that fall back to an older version
+		versions := make(map[string]bool)
+		for _, other := range IgmpQueriers {
+			if other.Interface == name && now.Sub(other.Last) <= other.OtherQuerierPresent() {
+				versions[other.Version] = true
+			}
+		}
+		if len(versions) > 1 {
+			var list []string
+			for v := range versions {
+				list = append(list, v)
+			}
+			sort.Strings(list)
+			z = append(z, fmt.Sprintf("Queriers on %s use different versions: %s", name, strings.Join(list, ", ")))
+		}
+		for _, member := range IgmpMembers {
+			if member.Interface == name && !member.Left && member.Version[:len(member.Version)-1] == q.Version[:len(q.Version)-1] && member.Version < q.Version && now.Sub(member.Last) <= q.OtherQuerierPresent() {
+				z = append(z, fmt.Sprintf("Host %s on %s reports %s with %s, older than the %s querier", member.Host, name, member.Group, member.Version, q.Version))
+			}
+		}
+	}
+	return z
+}
+
+// IgmpSummary describes the queriers, group members, problems, and recent messages seen. Mutex must be held.
+func IgmpSummary(now time.Time) string {
+	var b strings.Builder
+	elected := ElectedQueriers(now)
+	names := IgmpInterfaces()
+	if len(names) == 0 {
+		b.WriteString("No IGMP or MLD messages heard\n")
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(&b, "Queriers on %s\n", name)
+		fmt.Fprintf(&b, "  %-40s %-7s %-14s %-8s %-10s %-10s %s\n", "Address", "Version", "Query interval", "Observed", "Robustness", "Max resp", "Last query")
+		var queriers []*IgmpQuerier
+		for _, q := range IgmpQueriers {
+			if q.Interface == name {
+				queriers = append(queriers, q)
+			}
+		}
+		sort.Slice(queriers, func(i, j int) bool { return bytes.Compare(queriers[i].Addr.To16(), queriers[j].Addr.To16()) < 0 })
+		if len(queriers) == 0 {
+			b.WriteString("  none\n")
+		}
+		for _, q := range queriers {
+			addr := q.Addr.String()
+			if elected[name] == q {
+				addr += " (querier)"
+			}
+			fmt.Fprintf(&b, "  %-40s %-7s %-14s %-8s %-10d %-10s %s ago\n", addr, q.Version, q.QQI, q.Interval.Round(time.Second), q.QRV, q.MaxResp, now.Sub(q.Last).Round(time.Second))
+		}
+
+		var members []*IgmpMember
+		for _, m := range IgmpMembers {
+			if m.Interface == name {
+				members = append(members, m)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if !members[i].Group.Equal(members[j].Group) {
+				return bytes.Compare(members[i].Group.To16(), members[j].Group.To16()) < 0
+			}
+			return bytes.Compare(members[i].Host.To16(), members[j].Host.To16()) < 0
+		})
+		fmt.Fprintf(&b, "\nMembers on %s\n", name)
+		fmt.Fprintf(&b, "  %-40s %-40s %-7s %-8s %s\n", "Group", "Host", "Version", "Mode", "Last report")
+		if len(members) == 0 {
+			b.WriteString("  none\n")
+		}
+		for _, m := range members {
+			group := m.Group.String()
+			if m.Group.Equal(Group) {
+				group += " (test group)"
+			}
+			mode := m.Mode
+			if m.Left {
+				mode = "left"
+			}
+			fmt.Fprintf(&b, "  %-40s %-40s %-7s %-8s %s ago\n", group, m.Host, m.Version, mode, now.Sub(m.Last).Round(time.Second))
+		}
+		b.WriteString("\n")
+	}
+
+	if QuerierRegex != "" {
+		b.WriteString(QuerierSummary())
+		b.WriteString("\n")
+	}
+
+	b.WriteString("Problems\n")
+	problems := IgmpProblems(now)
+	if len(problems) == 0 {
+		b.WriteString("  None found\n")
+	}
+	for _, p := range problems {
+		fmt.Fprintf(&b, "  %s\n", p)
+	}
+
+	if len(IgmpRecent) > 0 {
+		b.WriteString("\nRecent messages\n")
+		for _, r := range IgmpRecent {
+			fmt.Fprintf(&b, "  %s\n", r)
+		}
+	}
+	return b.String()
+}
+
+// HandleIgmp decodes and stores an IGMP or MLD packet from a raw socket or capture file
+func HandleIgmp(p CapturedPacket) {
+	m, err := DecodeIgmp(p.Protocol, p.Payload)
+	if err != nil {
+		Debug("IGMP: %s from %s on %s: %v", p.Dst, p.Src, p.Interface, err)
+		return
+	}
+	if m == nil {
+		return
+	}
+	m.Time, m.Interface, m.Src, m.Dst = p.Time, p.Interface, p.Src, p.Dst
+	Mutex.Lock()
+	StoreIgmp(m)
+	Mutex.Unlock()
+}
+
+// MakeIgmp listens for IGMP or MLD on the usable interfaces, joining the groups reports and leaves are sent to
+func MakeIgmp(ifaces []net.Interface) {
+	protocol, groups := IgmpProtocol, IgmpAllRouters4
+	if Transport == "udp6" {
+		protocol, groups = MldProtocol, IgmpAllRouters6
+	}
+	created := RawSockets["IGMP"] == nil
+	MakeRawSocket("IGMP", protocol, groups, func(p CapturedPacket) {
+		p.Protocol = protocol
+		HandleIgmp(p)
+	})
+	if s := RawSockets["IGMP"]; s != nil {
+		// The built-in querier sends its queries on this socket
+		if created {
+			s.SetRouterAlert()
+		}
+		s.Join(ifaces)
+		Mutex.Lock()
+		for _, iface := range ifaces {
+			if IgmpSince[iface.Name].IsZero() {
+				IgmpSince[iface.Name] = Now()
+			}
+		}
+		Mutex.Unlock()
+	}
+}
+
+// AnalyzeIgmpFile prints what the IGMP and MLD packets in a capture file show, as of the last packet
+func AnalyzeIgmpFile(path string) error {
+	var last time.Time
+	err := ReadCaptureFile(path, func(p CapturedPacket) {
+		if p.Protocol != IgmpProtocol && p.Protocol != MldProtocol {
+			return
+		}
+		HandleIgmp(p)
+		if p.Time.After(last) {
+			last = p.Time
+		}
+	})
+	if err != nil {
+		return err
+	}
+	Mutex.Lock()
+	fmt.Print(IgmpSummary(last))
+	Mutex.Unlock()
+	return nil
+}
+
+func UpdateQueriers() {
+	Mutex.Lock()
+	text := IgmpSummary(Now())
+	Mutex.Unlock()
+	Queriers.SetText(cview.Escape(text))
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// IGMP and MLD messages assembled by hand from the formats in RFC 3376 and RFC 3810, without the IP header and with zero checksums
+var (
+	// IGMPv3 general query with max response 10s, QRV 2, and QQI 125s
+	IgmpQuery3Packet = "1164 0000 00000000 027d 0000"
+	// IGMPv2 general query with max response 10s
+	IgmpQuery2Packet = "1164 0000 00000000"
+	// IGMPv3 report with MODE_IS_INCLUDE 239.1.1.1 from 192.0.2.1, and CHANGE_TO_EXCLUDE 239.2.2.2 without sources
+	IgmpReport3Packet = "2200 0000 0000 0002 0100 0001 ef010101 c0000201 0400 0000 ef020202"
+	// MLDv2 report with BLOCK_OLD_SOURCES ff0e::1 from 2001:db8::1
+	MldReport2Packet = "8f00 0000 0000 0001 0600 0001 ff0e0000000000000000000000000001 20010db8000000000000000000000001"
+)
+
+func TestDecodeIgmp(t *testing.T) {
+	m, err := DecodeIgmp(IgmpProtocol, Hex(t, IgmpQuery3Packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "IGMPv3" || m.MaxResp != 10*time.Second || m.QRV != 2 || m.QQI != 125*time.Second {
+		t.Errorf("IGMPv3 query = %+v", m)
+	}
+	m, err = DecodeIgmp(IgmpProtocol, Hex(t, IgmpQuery2Packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "IGMPv2" || m.MaxResp != 10*time.Second {
+		t.Errorf("IGMPv2 query = %+v", m)
+	}
+
+	m, err = DecodeIgmp(IgmpProtocol, Hex(t, IgmpReport3Packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Records) != 2 {
+		t.Fatalf("IGMPv3 report has %d records, want 2", len(m.Records))
+	}
+	r := m.Records[0]
+	if r.Type != 1 || !r.Group.Equal(net.ParseIP("239.1.1.1")) || len(r.Sources) != 1 || !r.Sources[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("first record = %+v", r)
+	}
+	r = m.Records[1]
+	if r.Type != 4 || !r.Group.Equal(net.ParseIP("239.2.2.2")) || len(r.Sources) != 0 {
+		t.Errorf("second record = %+v", r)
+	}
+
+	m, err = DecodeIgmp(MldProtocol, Hex(t, MldReport2Packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Records) != 1 || m.Records[0].Type != 6 || !m.Records[0].Group.Equal(net.ParseIP("ff0e::1")) || len(m.Records[0].Sources) != 1 || !m.Records[0].Sources[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("MLDv2 report = %+v", m)
+	}
+}
+
+func TestDecodeIgmpTruncated(t *testing.T) {
+	for _, c := range []struct {
+		protocol int
+		packet   string
+	}{{IgmpProtocol, IgmpReport3Packet}, {MldProtocol, MldReport2Packet}} {
+		b := Hex(t, c.packet)
+		for n := 0; n < len(b); n++ {
+			if m, err := DecodeIgmp(c.protocol, b[:n]); err == nil {
+				t.Errorf("DecodeIgmp of %d bytes of %s = %+v, want an error", n, c.packet, m)
+			}
+		}
+	}
+
+	// A record of one byte
+	if _, err := DecodeIgmp(IgmpProtocol, Hex(t, "2200 0000 0000 0001 01")); err == nil {
+		t.Error("DecodeIgmp of a 9 byte report succeeded")
+	}
+}
+
+func TestIgmpRecords(t *testing.T) {
+	// Records with auxiliary data, which is skipped
+	b := Hex(t, "0002 0202 0001 ef010101 c0000201 00000000 00000000 0200 0000 ef020202")
+	records, err := IgmpRecords(b, 2, net.IPv4len)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Type != 2 || len(records[0].Sources) != 1 || records[1].Type != 2 || !records[1].Group.Equal(net.ParseIP("239.2.2.2")) {
+		t.Errorf("IgmpRecords = %+v", records)
+	}
+	if _, err := IgmpRecords(b, 3, net.IPv4len); err == nil {
+		t.Error("IgmpRecords of a missing record succeeded")
+	}
+}
+
+func TestStoreIgmp(t *testing.T) {
+	defer func() {
+		IgmpMembers = make(map[string]*IgmpMember)
+		IgmpSince = make(map[string]time.Time)
+		IgmpRecent = nil
+	}()
+	IgmpMembers = make(map[string]*IgmpMember)
+	for _, c := range []struct {
+		records []IgmpRecord
+		mode    string
+		left    bool
+	}{
+		{[]IgmpRecord{{Type: 4}}, "exclude", false},
+		{[]IgmpRecord{{Type: 6, Sources: []net.IP{net.ParseIP("192.0.2.1")}}}, "include", false},
+		{[]IgmpRecord{{Type: 5, Sources: []net.IP{net.ParseIP("192.0.2.1")}}}, "include", false},
+		{[]IgmpRecord{{Type: 3}}, "include", true},
+	} {
+		for i := range c.records {
+			c.records[i].Group = net.ParseIP("239.1.1.1")
+		}
+		StoreIgmp(&IgmpMessage{Type: IgmpReport3, Version: "IGMPv3", Time: time.Now(), Interface: "eth0", Src: net.ParseIP("10.0.0.5"), Records: c.records})
+		member := IgmpMembers["eth0 239.1.1.1 10.0.0.5"]
+		if member == nil || member.Mode != c.mode || member.Left != c.left {
+			t.Errorf("after record type %d, member = %+v, want mode %s left %v", c.records[0].Type, member, c.mode, c.left)
+		}
+	}
+}
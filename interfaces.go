@@ -0,0 +1,243 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.rocketnine.space/tslocum/cview"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+var (
+	// Data, guarded by Mutex, replaced on each pass of GetUsableInterfaces
+	InterfaceStates = make(map[string]*InterfaceState)
+
+	Interfaces = cview.NewTextView()
+)
+
+// InterfaceState is an interface considered by GetUsableInterfaces, with the reason it is not used if it is not
+type InterfaceState struct {
+	Name      string            `json:"name"`
+	Index     int               `json:"index"`
+	MTU       int               `json:"mtu"`
+	Flags     string            `json:"flags"`
+	Usable    bool              `json:"usable"`
+	Reason    string            `json:"reason,omitempty"`
+	Addresses []string          `json:"addresses"`
+	Rejected  map[string]string `json:"rejected,omitempty"`
+	Groups    []string          `json:"groups"`
+	Senders   []SenderState     `json:"senders"`
+}
+
+// SenderState is a sender on an interface
+type SenderState struct {
+	Address string `json:"address"`
+	Errors  int    `json:"errors"`
+	Largest int    `json:"largest"`
+	TooBig  bool   `json:"too_big"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WireSize returns the size of a datagram with a payload of size including the IP and UDP headers
+func WireSize(size int) int {
+	if Transport == "udp6" {
+		return size + 48
+	}
+	return size + 28
+}
+
+// ReportWireSize returns the largest datagram a report can take including the IP and UDP headers, since Split keeps each part within the larger of MaxSize and the padding. Mutex must be held.
+func ReportWireSize() int {
+	if Padding > MaxSize {
+		return WireSize(Padding)
+	}
+	return WireSize(MaxSize)
+}
+
+// CheckMTU warns when the largest datagram of a report stops or starts fitting the MTU of its interface, since they are dropped with fragmentation off, and notes the MTU sweep probes that cannot be sent. Mutex must be held.
+func CheckMTU(s *Socket) {
+	key := SenderKey(s.Iface, s.IP)
+	wire := ReportWireSize()
+	s.WireSize = wire
+	tooBig := !Fragments && s.Iface.MTU > 0 && wire > s.Iface.MTU
+	if tooBig != s.TooBig {
+		s.TooBig = tooBig
+		if tooBig {
+			Event(LevelWarn, Attrs{"event": "sender_mtu", "interface": s.Iface.Name, "address": s.IP.String(), "size": wire, "mtu": s.Iface.MTU}, "%s: %d byte datagrams exceed the %d byte MTU and cannot be sent without fragmentation", key, wire, s.Iface.MTU)
+		} else {
+			Event(LevelInfo, Attrs{"event": "sender_mtu", "interface": s.Iface.Name, "address": s.IP.String(), "size": wire, "mtu": s.Iface.MTU}, "%s: %d byte datagrams fit the %d byte MTU", key, wire, s.Iface.MTU)
+		}
+	}
+
+	// Probes above the MTU are expected to fail, so they are only noted once
+	var probes []int
+	for _, size := range MTUSweep {
+		if s.Iface.MTU > 0 && WireSize(size) > s.Iface.MTU {
+			probes = append(probes, size)
+		}
+	}
+	if msg := fmt.Sprint(probes); len(probes) > 0 && msg != s.ProbeMTU {
+		Debug("MTU sweep: %s: probes of %v bytes exceed the %d byte MTU and will not be sent", key, probes, s.Iface.MTU)
+		s.ProbeMTU = msg
+	}
+}
+
+// CheckMTUs checks every sender against the MTU of its interface before reports are sent with the current padding
+func CheckMTUs() {
+	Mutex.Lock()
+	for _, s := range Senders {
+		CheckMTU(s)
+	}
+	Mutex.Unlock()
+}
+
+// CapPadding reduces the padding so padded reports fit the smallest MTU of the interfaces with senders, or restores it when they fit
+func CapPadding() {
+	Mutex.Lock()
+	padding, limit := Size, ""
+	for _, s := range Senders {
+		if s.Iface.MTU <= 0 || Fragments {
+			continue
+		}
+		if fit := s.Iface.MTU - WireSize(0); fit < padding {
+			padding, limit = fit, fmt.Sprintf("the %d byte MTU of %s", s.Iface.MTU, s.Iface.Name)
+		}
+	}
+	changed := padding != Padding
+	if changed {
+		ZstdEncoder, Padding = NewZstdEncoder(padding), padding
+	}
+	Mutex.Unlock()
+
+	switch {
+	case changed && padding < Size:
+		Info("Padding reduced from %d to %d bytes to fit %s", Size, padding, limit)
+	case changed:
+		Info("Padding restored to %d bytes", padding)
+	}
+}
+
+// InterfaceSnapshot returns the state of every interface considered on the last pass, sorted by index, with the groups joined and senders of each
+func InterfaceSnapshot() []InterfaceState {
+	Mutex.Lock()
+	var z []InterfaceState
+	for _, state := range InterfaceStates {
+		state := *state
+		state.Addresses = append([]string{}, state.Addresses...)
+		state.Groups = []string{}
+		state.Senders = []SenderState{}
+		for key, s := range Senders {
+			if s.Iface.Name != state.Name {
+				continue
+			}
+			sender := SenderState{Address: s.IP.String(), Errors: SenderErrors[key], Largest: s.WireSize, TooBig: s.TooBig}
+			if s.Err != nil {
+				sender.Error = s.Err.Error()
+			}
+			state.Senders = append(state.Senders, sender)
+		}
+		sort.Slice(state.Senders, func(i, j int) bool { return IPLess(state.Senders[i].Address, state.Senders[j].Address) })
+		z = append(z, state)
+	}
+	Mutex.Unlock()
+
+	sort.Slice(z, func(i, j int) bool { return z[i].Index < z[j].Index })
+	for i := range z {
+		iface, err := net.InterfaceByIndex(z[i].Index)
+		if err != nil {
+			continue
+		}
+		groups, err := iface.MulticastAddrs()
+		if err != nil {
+			continue
+		}
+		for _, group := range groups {
+			z[i].Groups = append(z[i].Groups, group.String())
+		}
+	}
+	return z
+}
+
+// FirstUsableInterface returns the name of the usable interface with the lowest index, from the last pass of the socket loop
+func FirstUsableInterface() (string, error) {
+	Mutex.Lock()
+	defer Mutex.Unlock()
+	name, index := "", 0
+	for _, state := range InterfaceStates {
+		if state.Usable && (name == "" || state.Index < index) {
+			name, index = state.Name, state.Index
+		}
+	}
+	if name == "" {
+		return "", errors.New("no usable interfaces to reach the routers on the local link")
+	}
+	return name, nil
+}
+
+// InterfaceSummary describes every interface considered, why it is not used, and the senders on those that are
+func InterfaceSummary() string {
+	var b strings.Builder
+	Mutex.Lock()
+	fmt.Fprintf(&b, "Padding %d bytes, fragmentation %v\n", Padding, Fragments)
+	Mutex.Unlock()
+	states := InterfaceSnapshot()
+	if len(states) == 0 {
+		b.WriteString("\nNo interfaces found\n")
+	}
+	for _, state := range states {
+		status := "usable"
+		if !state.Usable {
+			status = "not used: " + state.Reason
+		}
+		fmt.Fprintf(&b, "\n%s (index %d), %s\n", state.Name, state.Index, status)
+		fmt.Fprintf(&b, "  MTU %d, flags %s\n", state.MTU, state.Flags)
+		if len(state.Addresses) > 0 {
+			fmt.Fprintf(&b, "  Addresses: %s\n", strings.Join(state.Addresses, ", "))
+		}
+		var rejected []string
+		for ip := range state.Rejected {
+			rejected = append(rejected, ip)
+		}
+		sort.Slice(rejected, func(i, j int) bool { return IPLess(rejected[i], rejected[j]) })
+		for _, ip := range rejected {
+			fmt.Fprintf(&b, "  Not used: %s\n", state.Rejected[ip])
+		}
+		if len(state.Groups) > 0 {
+			fmt.Fprintf(&b, "  Groups joined: %s\n", strings.Join(state.Groups, ", "))
+		}
+		for _, sender := range state.Senders {
+			largest := "nothing sent"
+			if sender.Largest > 0 {
+				largest = fmt.Sprintf("largest datagram %d bytes", sender.Largest)
+			}
+			if sender.TooBig {
+				largest += ", too big for the MTU"
+			}
+			fmt.Fprintf(&b, "  Sender %s: %s, %d errors", sender.Address, largest, sender.Errors)
+			if sender.Error != "" {
+				fmt.Fprintf(&b, ", last %s", sender.Error)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+func UpdateInterfaces() {
+	Interfaces.SetText(cview.Escape(InterfaceSummary()))
+}
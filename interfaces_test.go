@@ -0,0 +1,59 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheckMTU(t *testing.T) {
+	transport, fragments, maxSize, padding := Transport, Fragments, MaxSize, Padding
+	defer func() { Transport, Fragments, MaxSize, Padding = transport, fragments, maxSize, padding }()
+	Transport, Fragments, MaxSize = "udp4", false, 1400
+
+	tests := []struct {
+		transport string
+		padding   int
+		mtu       int
+		wire      int
+		tooBig    bool
+	}{
+		{"udp4", 0, 1500, 1428, false},
+		{"udp4", 1472, 1500, 1500, false},
+		{"udp4", 1473, 1500, 1501, true},
+		{"udp6", 1452, 1500, 1500, false},
+		{"udp6", 1472, 1500, 1520, true},
+		{"udp4", 9000, 0, 9028, false},
+	}
+	for _, test := range tests {
+		Transport, Padding = test.transport, test.padding
+		s := &Socket{Iface: net.Interface{Name: "eth0", MTU: test.mtu}, IP: net.ParseIP("10.0.0.1")}
+		CheckMTU(s)
+		if s.WireSize != test.wire || s.TooBig != test.tooBig {
+			t.Errorf("%s padding %d MTU %d: got %d %v, want %d %v", test.transport, test.padding, test.mtu, s.WireSize, s.TooBig, test.wire, test.tooBig)
+		}
+	}
+
+	// Senders recover when the padding shrinks
+	Transport, Padding = "udp4", 2000
+	s := &Socket{Iface: net.Interface{Name: "eth0", MTU: 1500}, IP: net.ParseIP("10.0.0.1")}
+	CheckMTU(s)
+	Padding = 1000
+	CheckMTU(s)
+	if s.TooBig {
+		t.Errorf("sender still too big after padding was reduced")
+	}
+}
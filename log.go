@@ -19,14 +19,51 @@ import (
 	"github.com/muesli/termenv"
 	"os"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelFatal
+)
+
+const (
+	// Number of log entries kept in memory, and how many of them are printed on exit due to a fatal error
+	LogLimit  = 10000
+	FatalTail = 100
 )
 
 var (
 	Colors        = termenv.ColorProfile()
-	FatalLog      strings.Builder
 	LogCandidates = make(map[string]string)
+
+	// Ring of recent log entries and the filters applied to the Log view
+	LogMutex   = new(sync.Mutex)
+	LogEntries = make([]LogEntry, 0, LogLimit)
+	LogNext    int
+	LogLevel   = LevelDebug
+	LogSearch  string
+
+	// Whether the TUI owns the terminal, guarded by LogMutex
+	ViewRunning bool
+
+	LevelNames  = []string{"DEBUG", "INFO", "WARN", "FATAL"}
+	LevelColors = []string{"aqua", "green", "yellow", "red"}
 )
 
+type LogEntry struct {
+	Time    time.Time
+	Level   int
+	Message string
+	Attrs   Attrs
+}
+
+// Attrs are structured fields attached to a log entry for machine-readable sinks
+type Attrs map[string]any
+
 func Aqua(s string) string {
 	return termenv.String(s).Foreground(Colors.Color("#2aa1b3")).String()
 }
@@ -40,29 +77,108 @@ func Red(s string) string {
 	return termenv.String(s).Foreground(Colors.Color("#f15f42")).String()
 }
 
+// ANSI formats an entry for printing to the terminal
+func (e LogEntry) ANSI() string {
+	level := LevelNames[e.Level]
+	switch e.Level {
+	case LevelDebug:
+		level = Aqua(level)
+	case LevelInfo:
+		level = Green(level)
+	case LevelWarn:
+		level = Yellow(level)
+	case LevelFatal:
+		level = Red(level)
+	}
+	return fmt.Sprintf("%s %s %s\n", e.Time.Format("01-02 15:04:05"), level, e.Message)
+}
+
+// Markup formats an entry for the Log view
+func (e LogEntry) Markup() string {
+	return fmt.Sprintf("[grey]%s[white] [%s]%s[white] %s\n", e.Time.Format("01-02 15:04:05"), LevelColors[e.Level], LevelNames[e.Level], e.Message)
+}
+
+// Shown reports whether an entry passes the Log view filters. LogMutex must be held.
+func (e LogEntry) Shown() bool {
+	if e.Level < LogLevel {
+		return false
+	}
+	return LogSearch == "" || strings.Contains(strings.ToLower(e.Message), LogSearch)
+}
+
+// Record adds an entry to the ring, replacing the oldest entry once the ring is full, and passes it to the sinks
+func Record(level int, attrs Attrs, s string) LogEntry {
+	e := LogEntry{Time: Now(), Level: level, Message: s, Attrs: attrs}
+	LogMutex.Lock()
+	for _, sink := range Sinks {
+		sink.Write(e)
+	}
+	if len(LogEntries) < LogLimit {
+		LogEntries = append(LogEntries, e)
+	} else {
+		LogEntries[LogNext] = e
+		LogNext = (LogNext + 1) % LogLimit
+	}
+	if e.Shown() {
+		fmt.Fprint(Log, e.Markup())
+	}
+	LogMutex.Unlock()
+	return e
+}
+
+// LogTail returns up to n of the most recent entries, oldest first. LogMutex must be held.
+func LogTail(n int) []LogEntry {
+	entries := append(append([]LogEntry{}, LogEntries[LogNext:]...), LogEntries[:LogNext]...)
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries
+}
+
+// RefreshLog redraws the Log view after the filters change
+func RefreshLog() {
+	LogMutex.Lock()
+	var b strings.Builder
+	for _, e := range LogTail(LogLimit) {
+		if e.Shown() {
+			b.WriteString(e.Markup())
+		}
+	}
+	Log.SetText(b.String())
+	Log.ScrollToEnd()
+	LogMutex.Unlock()
+}
+
 func Debug(format string, args ...any) {
 	if Verbose {
-		s := fmt.Sprintf(format, args...)
-		fmt.Fprintf(Log, "[aqua]DEBUG[white] %s\n", s)
-		FatalLog.WriteString(fmt.Sprintf("%s %s\n", Aqua("DEBUG"), s))
+		Record(LevelDebug, nil, fmt.Sprintf(format, args...))
 	}
 }
 
 func Info(format string, args ...any) {
-	s := fmt.Sprintf(format, args...)
-	fmt.Fprintf(Log, "[green]INFO[white] %s\n", s)
-	FatalLog.WriteString(fmt.Sprintf("%s %s\n", Green("INFO"), s))
+	Record(LevelInfo, nil, fmt.Sprintf(format, args...))
 }
 
 func Warn(format string, args ...any) {
-	s := fmt.Sprintf(format, args...)
-	fmt.Fprintf(Log, "[yellow]WARN[white] %s\n", s)
-	FatalLog.WriteString(fmt.Sprintf("%s %s\n", Yellow("WARN"), s))
+	Record(LevelWarn, nil, fmt.Sprintf(format, args...))
+}
+
+// Event logs a message with structured fields, such as the creation or deletion of a socket
+func Event(level int, attrs Attrs, format string, args ...any) {
+	if level > LevelDebug || Verbose {
+		Record(level, attrs, fmt.Sprintf(format, args...))
+	}
 }
 
 func Fatal(format string, args ...any) {
-	s := fmt.Sprintf(format, args...)
-	FatalLog.WriteString(fmt.Sprintf("%s %s\n", Red("FATAL"), s))
-	fmt.Print(FatalLog.String())
+	Record(LevelFatal, nil, fmt.Sprintf(format, args...))
+	Capture.Close()
+	LogMutex.Lock()
+	for _, sink := range Sinks {
+		sink.Close()
+	}
+	for _, e := range LogTail(FatalTail) {
+		fmt.Print(e.ANSI())
+	}
 	os.Exit(0)
 }
@@ -15,6 +15,9 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -22,25 +25,100 @@ func main() {
 	// Configure and initialize
 	Configure()
 
-	// Create sockets, check for errors and recreate as needed
+	// Analyze a capture file or trace a path and exit
+	if PimFile != "" {
+		err := AnalyzePimFile(PimFile)
+		if err != nil {
+			Fatal("PIM: %v", err)
+		}
+		return
+	}
+	if IgmpFile != "" {
+		err := AnalyzeIgmpFile(IgmpFile)
+		if err != nil {
+			Fatal("IGMP: %v", err)
+		}
+		return
+	}
+	if MtraceSource != "" {
+		err := MtraceCommand(MtraceSource)
+		if err != nil {
+			Fatal("Mtrace: %v", err)
+		}
+		return
+	}
+
+	if Replay != "" {
+		// Play back a recording through the views without sending or receiving
+		s, err := OpenReplay(Replay)
+		if err != nil {
+			Fatal("Replay: %v", err)
+		}
+		go PlayReplay(s)
+		go func() {
+			for range Reconfigure {
+				Warn("Settings cannot be changed during replay")
+			}
+		}()
+	} else {
+		Run()
+	}
+
+	// Run view
+	View()
+	Capture.Close()
+
+	// Write a final snapshot of the Reports table
+	if Export != "" {
+		err := WriteSnapshot(Export)
+		if err != nil {
+			Fatal("Export: %v", err)
+		}
+	}
+}
+
+// Run starts managing sockets and sending reports
+func Run() {
+	if MtraceStub {
+		MakeMtraceResponder()
+	}
+	if APIAddr != "" {
+		ServeAPI()
+	}
+
+	// Create sockets, check for errors and recreate as needed, immediately when interfaces change where supported
 	MakeSockets()
+	changed := make(chan struct{}, 1)
+	WatchInterfaces(changed)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		ticker := time.NewTicker(time.Second)
-		for range ticker.C {
+		for {
+			select {
+			case <-ticker.C:
+			case <-changed:
+			case s := <-Reconfigure:
+				ApplySettings(s)
+			case <-hup:
+				Reload()
+			}
 			CheckSockets()
 			MakeSockets()
 		}
 	}()
 
-	// Send reports to multicast group
+	// Send reports to multicast group, following changes to the rate
 	go func() {
 		SendReport()
-		ticker := time.NewTicker(time.Second / time.Duration(Rate))
+		rate := CurrentSettings().Rate
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
 		for range ticker.C {
 			SendReport()
+			if r := CurrentSettings().Rate; r != rate {
+				rate = r
+				ticker.Reset(time.Second / time.Duration(rate))
+			}
 		}
 	}()
-
-	// Run view
-	View()
 }
@@ -0,0 +1,517 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.rocketnine.space/tslocum/cview"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mtrace2 block types from RFC 8487
+const (
+	MtracePort      = 33435
+	MtraceQuery     = 0x01
+	MtraceRequest   = 0x02
+	MtraceReply     = 0x03
+	MtraceStandard  = 0x04
+	MtraceAugmented = 0x05
+	MtraceExtended  = 0x06
+	MtraceTimeout   = 3 * time.Second
+
+	// Counts that are not kept are all ones
+	MtraceNoCount = ^uint64(0)
+)
+
+var (
+	MtraceCodes = map[int]string{
+		0x00: "NO_ERROR",
+		0x01: "WRONG_IF",
+		0x02: "PRUNE_SENT",
+		0x03: "PRUNE_RCVD",
+		0x04: "SCOPED",
+		0x05: "NO_ROUTE",
+		0x06: "WRONG_LAST_HOP",
+		0x07: "NOT_FORWARDING",
+		0x08: "REACHED_RP",
+		0x09: "RPF_IF",
+		0x0a: "NO_MULTICAST",
+		0x0b: "INFO_HIDDEN",
+		0x0c: "REACHED_GW",
+		0x0d: "UNKNOWN_QUERY",
+		0x80: "FATAL_ERROR",
+		0x81: "NO_SPACE",
+		0x83: "ADMIN_PROHIB",
+	}
+
+	MtraceResponder *net.UDPConn
+
+	Trace       = cview.NewTextView()
+	TraceSource = cview.NewInputField()
+	TraceRouter = cview.NewInputField()
+)
+
+// MtraceHeader is a Query, Request, or Reply
+type MtraceHeader struct {
+	Type   int
+	Hops   int
+	Group  net.IP
+	Source net.IP
+	Client net.IP
+	ID     int
+	Port   int
+}
+
+// MtraceHop is a Standard Response Block, added by each router along the path from the receiver toward the source. IPv6 blocks carry only a local and a remote address, which are kept in In and Upstream.
+type MtraceHop struct {
+	Arrival       uint32
+	InID          uint32
+	OutID         uint32
+	In            net.IP
+	Out           net.IP
+	Upstream      net.IP
+	InCount       uint64
+	OutCount      uint64
+	Total         uint64
+	RtgProtocol   int
+	McastProtocol int
+	FwdTTL        int
+	S             bool
+	PrefixLen     int
+	Code          int
+}
+
+// MtraceCode names a forwarding code
+func MtraceCode(code int) string {
+	if name, ok := MtraceCodes[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// Append adds the header to b as a TLV
+func (h *MtraceHeader) Append(b []byte) []byte {
+	b = append(b, byte(h.Type), 0, 0, byte(h.Hops))
+	start := len(b)
+	b = append(b, AddrBytes(h.Group)...)
+	b = append(b, AddrBytes(h.Source)...)
+	b = append(b, AddrBytes(h.Client)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(h.ID))
+	b = binary.BigEndian.AppendUint16(b, uint16(h.Port))
+	binary.BigEndian.PutUint16(b[start-3:], uint16(len(b)-start+1))
+	return b
+}
+
+// Append adds the hop to b as a Standard Response Block
+func (hop *MtraceHop) Append(b []byte, v6 bool) []byte {
+	b = append(b, MtraceStandard, 0, 0, 0)
+	start := len(b)
+	b = binary.BigEndian.AppendUint32(b, hop.Arrival)
+	b = binary.BigEndian.AppendUint32(b, hop.InID)
+	b = binary.BigEndian.AppendUint32(b, hop.OutID)
+	if v6 {
+		b = append(b, To16(hop.In)...)
+		b = append(b, To16(hop.Upstream)...)
+	} else {
+		b = append(b, To4(hop.In)...)
+		b = append(b, To4(hop.Out)...)
+		b = append(b, To4(hop.Upstream)...)
+	}
+	b = binary.BigEndian.AppendUint64(b, hop.InCount)
+	b = binary.BigEndian.AppendUint64(b, hop.OutCount)
+	b = binary.BigEndian.AppendUint64(b, hop.Total)
+	b = binary.BigEndian.AppendUint16(b, uint16(hop.RtgProtocol))
+	b = binary.BigEndian.AppendUint16(b, uint16(hop.McastProtocol))
+	s := byte(0)
+	if hop.S {
+		s = 1
+	}
+	b = append(b, byte(hop.FwdTTL), s, byte(hop.PrefixLen), byte(hop.Code))
+	binary.BigEndian.PutUint16(b[start-3:], uint16(len(b)-start+1))
+	return b
+}
+
+// AddrBytes returns the 4 or 16 bytes of an address as sent in mtrace2 blocks
+func AddrBytes(ip net.IP) []byte {
+	if ip.To4() != nil {
+		return ip.To4()
+	}
+	return To16(ip)
+}
+
+// To4 returns the 4 bytes of an IPv4 address, or zeros if it is not one
+func To4(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return make([]byte, net.IPv4len)
+}
+
+// To16 returns the 16 bytes of an address, or zeros if it is not set
+func To16(ip net.IP) []byte {
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16
+	}
+	return make([]byte, net.IPv6len)
+}
+
+// DecodeMtrace decodes an mtrace2 message, skipping Augmented Response Blocks and Extended Query Blocks
+func DecodeMtrace(b []byte) (h *MtraceHeader, hops []MtraceHop, err error) {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, nil, errors.New("truncated block")
+		}
+		t, n := int(b[0]), int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+n {
+			return nil, nil, fmt.Errorf("block type %d is truncated", t)
+		}
+		v := b[3 : 3+n]
+		b = b[3+n:]
+		switch t {
+		case MtraceQuery, MtraceRequest, MtraceReply:
+			if h != nil {
+				return nil, nil, errors.New("more than one header")
+			}
+			// The value holds the hops, three addresses, the query ID, and the client port
+			l := (n - 5) / 3
+			if l != net.IPv4len && l != net.IPv6len || n != 5+3*l {
+				return nil, nil, fmt.Errorf("header length %d is invalid", n)
+			}
+			h = &MtraceHeader{Type: t, Hops: int(v[0])}
+			h.Group = net.IP(append([]byte{}, v[1:1+l]...))
+			h.Source = net.IP(append([]byte{}, v[1+l:1+2*l]...))
+			h.Client = net.IP(append([]byte{}, v[1+2*l:1+3*l]...))
+			h.ID = int(binary.BigEndian.Uint16(v[1+3*l:]))
+			h.Port = int(binary.BigEndian.Uint16(v[3+3*l:]))
+		case MtraceStandard:
+			if h == nil {
+				return nil, nil, errors.New("response block before header")
+			}
+			v6 := h.Group.To4() == nil
+			want := 1 + 12 + 3*net.IPv4len + 24 + 8
+			if v6 {
+				want = 1 + 12 + 2*net.IPv6len + 24 + 8
+			}
+			if n < want {
+				return nil, nil, fmt.Errorf("response block length %d is too short", n)
+			}
+			hop := MtraceHop{Arrival: binary.BigEndian.Uint32(v[1:]), InID: binary.BigEndian.Uint32(v[5:]), OutID: binary.BigEndian.Uint32(v[9:])}
+			v = v[13:]
+			if v6 {
+				hop.In, hop.Upstream = net.IP(append([]byte{}, v[:16]...)), net.IP(append([]byte{}, v[16:32]...))
+				v = v[32:]
+			} else {
+				hop.In, hop.Out, hop.Upstream = net.IP(append([]byte{}, v[:4]...)), net.IP(append([]byte{}, v[4:8]...)), net.IP(append([]byte{}, v[8:12]...))
+				v = v[12:]
+			}
+			hop.InCount, hop.OutCount, hop.Total = binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:]), binary.BigEndian.Uint64(v[16:])
+			hop.RtgProtocol, hop.McastProtocol = int(binary.BigEndian.Uint16(v[24:])), int(binary.BigEndian.Uint16(v[26:]))
+			hop.FwdTTL, hop.S, hop.PrefixLen, hop.Code = int(v[28]), v[29]&1 != 0, int(v[30]), int(v[31])
+			hops = append(hops, hop)
+		case MtraceAugmented, MtraceExtended:
+		default:
+			return nil, nil, fmt.Errorf("unknown block type %d", t)
+		}
+	}
+	if h == nil {
+		return nil, nil, errors.New("no header")
+	}
+	return h, hops, nil
+}
+
+// NtpShort returns the middle 32 bits of the NTP timestamp of t, as used for query arrival times
+func NtpShort(t time.Time) uint32 {
+	secs := uint64(t.Unix()+2208988800) << 16
+	frac := uint64(t.Nanosecond()) << 16 / uint64(time.Second)
+	return uint32(secs | frac)
+}
+
+// Mtrace asks router, or the routers on the local link if router is nil, for the path from this host back to source for Group
+func Mtrace(source net.IP, router net.IP, hops int) (*MtraceHeader, []MtraceHop, error) {
+	Mutex.Lock()
+	group, transport := Group, Transport
+	Mutex.Unlock()
+	if (source.To4() == nil) != (group.To4() == nil) {
+		return nil, nil, fmt.Errorf("source %s is not in the address family of group %s", source, group)
+	}
+	if router == nil {
+		router = IgmpAllRouters4[0]
+		if transport == "udp6" {
+			router = IgmpAllRouters6[0]
+		}
+	}
+	dst := &net.UDPAddr{IP: router, Port: MtracePort}
+	if router.IsLinkLocalMulticast() && transport == "udp6" {
+		zone, err := FirstUsableInterface()
+		if err != nil {
+			return nil, nil, err
+		}
+		dst.Zone = zone
+	}
+
+	// The client address is the one this host would use to reach the router
+	client := LocalAddrFor(router, dst.Zone)
+	if client == nil {
+		return nil, nil, fmt.Errorf("no route to %s", router)
+	}
+
+	conn, err := net.ListenUDP(transport, &net.UDPAddr{IP: client, Zone: dst.Zone})
+	if err != nil {
+		return nil, nil, fmt.Errorf("net.ListenUDP(%s, %s): %v", transport, client, err)
+	}
+	defer conn.Close()
+	if router.IsMulticast() {
+		if transport == "udp6" {
+			_ = ipv6.NewPacketConn(conn).SetMulticastHopLimit(1)
+		} else {
+			_ = ipv4.NewPacketConn(conn).SetMulticastTTL(1)
+		}
+	}
+
+	q := MtraceHeader{Type: MtraceQuery, Hops: hops, Group: group, Source: source, Client: client, ID: rand.Intn(1 << 16), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	_, err = conn.WriteToUDP(q.Append(nil), dst)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Conn.WriteToUDP(%v): %v", dst, err)
+	}
+	Debug("Mtrace: query %d for %s from %s sent to %s", q.ID, group, source, router)
+
+	b := make([]byte, 65536)
+	deadline := time.Now().Add(MtraceTimeout)
+	for {
+		_ = conn.SetReadDeadline(deadline)
+		n, from, err := conn.ReadFromUDP(b)
+		if err != nil {
+			var timeout net.Error
+			if errors.As(err, &timeout) && timeout.Timeout() {
+				return nil, nil, fmt.Errorf("no reply from %s within %s", router, MtraceTimeout)
+			}
+			return nil, nil, fmt.Errorf("Conn.ReadFromUDP: %v", err)
+		}
+		h, hops, err := DecodeMtrace(b[:n])
+		if err != nil {
+			Debug("Mtrace: %v from %s", err, from)
+			continue
+		}
+		if h.Type == MtraceReply && h.ID == q.ID {
+			return h, hops, nil
+		}
+	}
+}
+
+// MtraceSummary describes a trace, one hop per line from the receiver toward the source
+func MtraceSummary(source net.IP, h *MtraceHeader, hops []MtraceHop, err error) string {
+	Mutex.Lock()
+	group := Group
+	Mutex.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Mtrace from %s for %s\n\n", source, group)
+	if err != nil {
+		fmt.Fprintf(&b, "  %v\n", err)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "  Reply to query %d from %s\n\n", h.ID, h.Client)
+	fmt.Fprintf(&b, "  %-4s %-40s %-40s %-40s %-15s %-8s %-10s %s\n", "Hop", "Incoming", "Outgoing", "Upstream", "Code", "Fwd TTL", "Protocol", "Packets in/out/total")
+	count := func(c uint64) string {
+		if c == MtraceNoCount {
+			return "-"
+		}
+		return fmt.Sprint(c)
+	}
+	for i, hop := range hops {
+		out := "-"
+		if hop.Out != nil {
+			out = hop.Out.String()
+		}
+		fmt.Fprintf(&b, "  %-4d %-40s %-40s %-40s %-15s %-8d %-10d %s/%s/%s\n", -i, hop.In, out, hop.Upstream, MtraceCode(hop.Code), hop.FwdTTL, hop.McastProtocol, count(hop.InCount), count(hop.OutCount), count(hop.Total))
+	}
+	if len(hops) == 0 {
+		b.WriteString("  No routers responded\n")
+		return b.String()
+	}
+
+	// The tree breaks at the first hop with an error, or is incomplete if the last hop is not the source's router
+	last := hops[len(hops)-1]
+	for i, hop := range hops {
+		if hop.Code != 0 && hop.Code != 0x08 && hop.Code != 0x0c {
+			fmt.Fprintf(&b, "\n  The path breaks at hop %d (%s): %s\n", -i, hop.In, MtraceCode(hop.Code))
+			return b.String()
+		}
+	}
+	if !last.Upstream.Equal(source) && !last.Upstream.IsUnspecified() {
+		fmt.Fprintf(&b, "\n  The trace stopped after %d hops before reaching the source\n", len(hops))
+	}
+	return b.String()
+}
+
+// MakeMtraceResponder answers mtrace2 queries as if this host were the only router between its receivers and the sources it hears
+func MakeMtraceResponder() {
+	a := net.UDPAddr{Port: MtracePort}
+	conn, err := net.ListenUDP(Transport, &a)
+	if err != nil {
+		Warn("Mtrace: net.ListenUDP(%s, %v): %v", Transport, a, err)
+		return
+	}
+	Info("Mtrace: responding on port %d", MtracePort)
+	MtraceResponder = conn
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				Warn("Mtrace: Conn.ReadFromUDP: %v", err)
+				return
+			}
+			reply, client, err := MtraceRespond(b[:n], from, Now())
+			if err != nil {
+				Debug("Mtrace: %v from %s", err, from)
+				continue
+			}
+			_, err = conn.WriteToUDP(reply, client)
+			if err != nil {
+				Warn("Mtrace: Conn.WriteToUDP(%v): %v", client, err)
+			}
+		}
+	}()
+}
+
+// MtraceRespond adds a response block to a query or request and returns the reply with the address of the client
+func MtraceRespond(b []byte, from *net.UDPAddr, now time.Time) ([]byte, *net.UDPAddr, error) {
+	h, hops, err := DecodeMtrace(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Type != MtraceQuery && h.Type != MtraceRequest {
+		return nil, nil, fmt.Errorf("unexpected block type %d", h.Type)
+	}
+	v6 := h.Group.To4() == nil
+
+	// Forwarding is fine if the source was heard within the stale interval
+	hop := MtraceHop{Arrival: NtpShort(now), In: LocalAddrFor(h.Source, ""), Out: LocalAddrFor(from.IP, from.Zone), Upstream: h.Source, InCount: MtraceNoCount, OutCount: MtraceNoCount, Total: MtraceNoCount, Code: 0x05}
+	Mutex.Lock()
+	t, heard := HeardIPs[h.Source.String()]
+	group, stale := Group, Stale
+	Mutex.Unlock()
+	switch {
+	case !h.Group.Equal(group):
+		hop.Code = 0x07
+	case heard && now.Sub(t) <= stale:
+		hop.Code = 0x00
+	case heard:
+		hop.Code = 0x07
+	}
+	if hop.Code != 0 {
+		hop.Upstream = net.IPv4zero
+		if v6 {
+			hop.Upstream = net.IPv6unspecified
+		}
+	}
+
+	reply := *h
+	reply.Type = MtraceReply
+	z := reply.Append(nil)
+	for _, prev := range hops {
+		z = prev.Append(z, v6)
+	}
+	z = hop.Append(z, v6)
+	Event(LevelInfo, Attrs{"event": "mtrace_reply", "source": h.Source.String(), "group": h.Group.String(), "client": h.Client.String(), "code": MtraceCode(hop.Code)}, "Mtrace: replied to %s for %s from %s with %s", h.Client, h.Group, h.Source, MtraceCode(hop.Code))
+	return z, &net.UDPAddr{IP: h.Client, Port: h.Port}, nil
+}
+
+// LocalAddrFor returns the address this host would use to reach ip, or nil if there is no route
+func LocalAddrFor(ip net.IP, zone string) net.IP {
+	probe, err := net.DialUDP(TransportFor(ip), nil, &net.UDPAddr{IP: ip, Port: MtracePort, Zone: zone})
+	if err != nil {
+		return nil
+	}
+	local := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+	return local
+}
+
+// TraceHelp shows how to start a trace in the Trace view
+func TraceHelp() {
+	Trace.SetText("Press / to enter a source and optionally the last hop router of the receiver, then Enter to trace the path back to the source\n\n" + cview.Escape(HeardSources()))
+}
+
+// StartTrace runs a trace from the Trace view in the background
+func StartTrace() {
+	source := net.ParseIP(strings.TrimSpace(TraceSource.GetText()))
+	if source == nil {
+		TraceHelp()
+		return
+	}
+	var router net.IP
+	if text := strings.TrimSpace(TraceRouter.GetText()); text != "" {
+		router = net.ParseIP(text)
+		if router == nil {
+			Trace.SetText(fmt.Sprintf("Router %s is not an address", cview.Escape(text)))
+			return
+		}
+	}
+	Mutex.Lock()
+	group := Group
+	Mutex.Unlock()
+	Trace.SetText(fmt.Sprintf("Tracing from %s for %s...", source, group))
+	go func() {
+		h, hops, err := Mtrace(source, router, MtraceHops)
+		Trace.SetText(cview.Escape(MtraceSummary(source, h, hops, err)))
+	}()
+}
+
+// HeardSources lists the IPs reports have been heard from, most recent first
+func HeardSources() string {
+	Mutex.Lock()
+	var ips []string
+	for ip := range HeardIPs {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return HeardIPs[ips[i]].After(HeardIPs[ips[j]]) })
+	now := Now()
+	var b strings.Builder
+	b.WriteString("Sources heard\n")
+	if len(ips) == 0 {
+		b.WriteString("  None yet\n")
+	}
+	for _, ip := range ips {
+		fmt.Fprintf(&b, "  %-40s %s ago\n", ip, now.Sub(HeardIPs[ip]).Round(time.Second))
+	}
+	Mutex.Unlock()
+	return b.String()
+}
+
+// MtraceCommand runs a trace from the command line and prints the result
+func MtraceCommand(source string) error {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return fmt.Errorf("source %s is not an address", source)
+	}
+	var router net.IP
+	if MtraceRouter != "" {
+		router = net.ParseIP(MtraceRouter)
+	}
+	// There is no socket loop to find the interfaces of the local link
+	GetUsableInterfaces()
+	h, hops, err := Mtrace(ip, router, MtraceHops)
+	fmt.Print(MtraceSummary(ip, h, hops, err))
+	return err
+}
@@ -0,0 +1,547 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packets are written to a pcapng file as raw IP packets, with the IP and UDP headers synthesized from what the sockets know
+const (
+	PcapLinkTypeRaw = 101
+	PcapInbound     = 1
+	PcapOutbound    = 2
+	PcapUnknownTTL  = 0
+
+	// Packets waiting to be written before more are dropped
+	PcapQueue = 1024
+)
+
+var (
+	Capture *Pcap
+)
+
+// Pcap queues packets to a goroutine that describes and writes them, so decoding reports for the comments stays out of the send and receive paths
+type Pcap struct {
+	File    *os.File
+	ID      uint16
+	Done    chan struct{}
+	Dropped int
+
+	// Guarded by Mutex, nil once closed
+	Mutex sync.Mutex
+	Queue chan PcapPacket
+}
+
+// PcapPacket is a datagram waiting to be written
+type PcapPacket struct {
+	Src       *net.UDPAddr
+	Dst       *net.UDPAddr
+	TTL       int
+	TOS       int
+	DF        bool
+	Direction uint32
+	Payload   []byte
+	Time      time.Time
+}
+
+// OpenPcap creates a pcapng file with a single interface for every packet
+func OpenPcap(path string) (*Pcap, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Section header block
+	b := PcapBlock(0x0a0d0d0a, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil)
+
+	// Interface description block, with timestamps in nanoseconds
+	idb := binary.LittleEndian.AppendUint16(nil, PcapLinkTypeRaw)
+	idb = append(idb, 0, 0, 0, 0, 0, 0)
+	b = append(b, PcapBlock(1, idb, [][]byte{PcapOption(2, []byte("macy")), PcapOption(9, []byte{9})})...)
+
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p := &Pcap{File: f, Done: make(chan struct{}), Queue: make(chan PcapPacket, PcapQueue)}
+	go p.Run(p.Queue)
+	return p, nil
+}
+
+// PcapBlock returns a block with its body and options, padded to 32 bits
+func PcapBlock(kind uint32, body []byte, options [][]byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	if len(options) > 0 {
+		for _, o := range options {
+			body = append(body, o...)
+		}
+		body = append(body, 0, 0, 0, 0)
+	}
+	l := uint32(12 + len(body))
+	z := binary.LittleEndian.AppendUint32(nil, kind)
+	z = binary.LittleEndian.AppendUint32(z, l)
+	z = append(z, body...)
+	return binary.LittleEndian.AppendUint32(z, l)
+}
+
+func PcapOption(code uint16, value []byte) []byte {
+	z := binary.LittleEndian.AppendUint16(nil, code)
+	z = binary.LittleEndian.AppendUint16(z, uint16(len(value)))
+	z = append(z, value...)
+	for len(z)%4 != 0 {
+		z = append(z, 0)
+	}
+	return z
+}
+
+// Write queues a datagram, where direction is PcapInbound or PcapOutbound. The payload is copied, so callers may reuse it.
+func (p *Pcap) Write(src *net.UDPAddr, dst *net.UDPAddr, ttl int, tos int, df bool, direction uint32, payload []byte, t time.Time) {
+	if p == nil {
+		return
+	}
+	packet := PcapPacket{Src: src, Dst: dst, TTL: ttl, TOS: tos, DF: df, Direction: direction, Payload: append([]byte(nil), payload...), Time: t}
+	p.Mutex.Lock()
+	if p.Queue != nil {
+		select {
+		case p.Queue <- packet:
+		default:
+			p.Dropped++
+		}
+	}
+	p.Mutex.Unlock()
+}
+
+// Run writes the queued packets, each with a comment describing the report it holds, until the queue is closed
+func (p *Pcap) Run(queue chan PcapPacket) {
+	defer close(p.Done)
+	for packet := range queue {
+		if p.File == nil {
+			continue
+		}
+		comment := ReportComment(packet.Payload)
+		if len(comment) > 65000 {
+			comment = comment[:65000] + "..."
+		}
+		p.ID++
+		ip := IPPacket(packet.Src, packet.Dst, packet.TTL, packet.TOS, packet.DF, p.ID, packet.Payload)
+
+		ts := uint64(packet.Time.UnixNano())
+		epb := binary.LittleEndian.AppendUint32(nil, 0)
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(ip)))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(ip)))
+		epb = append(epb, ip...)
+		options := [][]byte{PcapOption(2, binary.LittleEndian.AppendUint32(nil, packet.Direction))}
+		if comment != "" {
+			options = append(options, PcapOption(1, []byte(comment)))
+		}
+
+		_, err := p.File.Write(PcapBlock(6, epb, options))
+		if err != nil {
+			Warn("Packet capture stopped: %v", err)
+			p.File.Close()
+			p.File = nil
+		}
+	}
+	if p.File != nil {
+		p.File.Close()
+		p.File = nil
+	}
+}
+
+// Close writes the packets still queued and closes the file
+func (p *Pcap) Close() {
+	if p == nil {
+		return
+	}
+	p.Mutex.Lock()
+	if p.Queue != nil {
+		close(p.Queue)
+		p.Queue = nil
+	}
+	dropped := p.Dropped
+	p.Mutex.Unlock()
+	<-p.Done
+	if dropped > 0 {
+		Warn("Packet capture dropped %d packets that arrived faster than they could be written", dropped)
+	}
+}
+
+// IPPacket returns an IPv4 or IPv6 packet holding a UDP datagram, using the unspecified address for a wildcard or unknown address
+func IPPacket(src *net.UDPAddr, dst *net.UDPAddr, ttl int, tos int, df bool, id uint16, payload []byte) []byte {
+	known := func(ip net.IP) bool { return ip != nil && !ip.IsUnspecified() }
+	v4 := dst.IP.To4() != nil
+	if !known(dst.IP) {
+		v4 = src.IP.To4() != nil
+	}
+	unspecified := net.IPv6unspecified
+	if v4 {
+		unspecified = net.IPv4zero
+	}
+	srcIP, dstIP := src.IP, dst.IP
+	if !known(srcIP) {
+		srcIP = unspecified
+	}
+	if !known(dstIP) {
+		dstIP = unspecified
+	}
+
+	udp := binary.BigEndian.AppendUint16(nil, uint16(src.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(dst.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(8+len(payload)))
+	udp = append(udp, 0, 0)
+	udp = append(udp, payload...)
+
+	var z, pseudo []byte
+	if v4 {
+		z = []byte{0x45, uint8(tos)}
+		z = binary.BigEndian.AppendUint16(z, uint16(20+len(udp)))
+		z = binary.BigEndian.AppendUint16(z, id)
+		if df {
+			z = append(z, 0x40, 0)
+		} else {
+			z = append(z, 0, 0)
+		}
+		z = append(z, uint8(ttl), 17, 0, 0)
+		z = append(z, srcIP.To4()...)
+		z = append(z, dstIP.To4()...)
+		binary.BigEndian.PutUint16(z[10:], Checksum(z))
+		pseudo = append(append(append([]byte{}, srcIP.To4()...), dstIP.To4()...), 0, 17)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(udp)))
+	} else {
+		z = binary.BigEndian.AppendUint32(nil, 6<<28|uint32(tos)<<20)
+		z = binary.BigEndian.AppendUint16(z, uint16(len(udp)))
+		z = append(z, 17, uint8(ttl))
+		z = append(z, srcIP.To16()...)
+		z = append(z, dstIP.To16()...)
+		pseudo = append(append([]byte{}, srcIP.To16()...), dstIP.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(udp)))
+		pseudo = append(pseudo, 0, 0, 0, 17)
+	}
+
+	sum := Checksum(append(pseudo, udp...))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], sum)
+	return append(z, udp...)
+}
+
+// Checksum returns the internet checksum of b
+func Checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// ReportComment describes the decoded report in a datagram, since reports are compressed on the wire
+func ReportComment(b []byte) string {
+	r := Decode(b)
+	if r == nil {
+		return ""
+	}
+	var ips []string
+	for ip := range r.Heard {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return IPLess(ips[i], ips[j]) })
+	var c strings.Builder
+	fmt.Fprintf(&c, "macy report %q from %s", b[:4], r.Host)
+	if r.Total > 1 {
+		fmt.Fprintf(&c, ", seq %d part %d of %d", r.Seq, r.Part+1, r.Total)
+	}
+	if r.Beacon {
+		c.WriteString(", beacon")
+	}
+	if len(r.Local) > 0 {
+		fmt.Fprintf(&c, ", local %s", strings.Join(r.Local, " "))
+	}
+	if r.TTL > 0 {
+		fmt.Fprintf(&c, ", sent with TTL %d", r.TTL)
+	}
+	if r.Probe > 0 {
+		fmt.Fprintf(&c, ", probe of %d bytes", r.Probe)
+	}
+	fmt.Fprintf(&c, ", heard %d:", len(ips))
+	for _, ip := range ips {
+		fmt.Fprintf(&c, " %s=%.3fs", ip, r.Heard[ip].Seconds())
+	}
+	return c.String()
+}
+
+// CapturedPacket is an IP packet read from a capture file
+type CapturedPacket struct {
+	Time      time.Time
+	Interface string
+	Src       net.IP
+	Dst       net.IP
+	Protocol  int
+	TTL       int
+	Payload   []byte
+}
+
+// ReadCaptureFile calls packet for each IP packet in a pcap or pcapng file, skipping anything else
+func ReadCaptureFile(path string, packet func(CapturedPacket)) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(b) < 24 {
+		return fmt.Errorf("%s: file is too short", path)
+	}
+
+	// Classic pcap, in either byte order and with timestamps in micro or nanoseconds
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		magic := order.Uint32(b)
+		if magic != 0xa1b2c3d4 && magic != 0xa1b23c4d {
+			continue
+		}
+		scale := time.Microsecond
+		if magic == 0xa1b23c4d {
+			scale = time.Nanosecond
+		}
+		linkType := int(order.Uint32(b[20:]) & 0xffff)
+		b = b[24:]
+		for len(b) >= 16 {
+			l := int(order.Uint32(b[8:]))
+			if len(b) < 16+l {
+				return fmt.Errorf("%s: packet is truncated", path)
+			}
+			t := time.Unix(int64(order.Uint32(b)), 0).Add(time.Duration(order.Uint32(b[4:])) * scale)
+			if p, ok := ParseFrame(linkType, b[16:16+l]); ok {
+				p.Time, p.Interface = t, "capture"
+				packet(p)
+			}
+			b = b[16+l:]
+		}
+		return nil
+	}
+
+	if binary.LittleEndian.Uint32(b) != 0x0a0d0d0a {
+		return fmt.Errorf("%s: not a pcap or pcapng file", path)
+	}
+	return ReadPcapng(path, b, packet)
+}
+
+// ReadPcapng reads the sections of a pcapng file, each of which has its own byte order and interfaces
+func ReadPcapng(path string, b []byte, packet func(CapturedPacket)) error {
+	type pcapInterface struct {
+		linkType int
+		name     string
+		scale    float64
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	var ifaces []pcapInterface
+	for len(b) >= 12 {
+		if binary.LittleEndian.Uint32(b) == 0x0a0d0d0a {
+			switch binary.LittleEndian.Uint32(b[8:]) {
+			case 0x1a2b3c4d:
+				order = binary.LittleEndian
+			case 0x4d3c2b1a:
+				order = binary.BigEndian
+			default:
+				return fmt.Errorf("%s: unrecognized byte order", path)
+			}
+			ifaces = nil
+		}
+		kind, l := order.Uint32(b), int(order.Uint32(b[4:]))
+		if l < 12 || l > len(b) {
+			return fmt.Errorf("%s: block is truncated", path)
+		}
+		body := b[8 : l-4]
+		b = b[l:]
+
+		switch kind {
+		case 1:
+			// Interface description, with the name and timestamp resolution from its options
+			if len(body) < 8 {
+				continue
+			}
+			iface := pcapInterface{linkType: int(order.Uint16(body)), name: fmt.Sprintf("capture%d", len(ifaces)), scale: 1e-6}
+			for o := body[8:]; len(o) >= 4; {
+				code, ol := order.Uint16(o), int(order.Uint16(o[2:]))
+				if code == 0 || len(o) < 4+ol {
+					break
+				}
+				value := o[4 : 4+ol]
+				switch {
+				case code == 2:
+					iface.name = string(value)
+				case code == 9 && ol == 1:
+					if value[0]&0x80 == 0 {
+						iface.scale = math.Pow(10, -float64(value[0]))
+					} else {
+						iface.scale = math.Pow(2, -float64(value[0]&0x7f))
+					}
+				}
+				// The padding of the last option may be missing
+				next := 4 + (ol+3)/4*4
+				if next > len(o) {
+					next = len(o)
+				}
+				o = o[next:]
+			}
+			ifaces = append(ifaces, iface)
+		case 6:
+			// Enhanced packet
+			if len(body) < 20 {
+				continue
+			}
+			id, capLen := int(order.Uint32(body)), int(order.Uint32(body[12:]))
+			if id >= len(ifaces) || len(body) < 20+capLen {
+				continue
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			seconds := float64(ts) * ifaces[id].scale
+			if p, ok := ParseFrame(ifaces[id].linkType, body[20:20+capLen]); ok {
+				p.Time = time.Unix(0, int64(seconds*1e9))
+				p.Interface = ifaces[id].name
+				packet(p)
+			}
+		case 3:
+			// Simple packet, which has no timestamp and always belongs to the first interface
+			if len(body) < 4 || len(ifaces) == 0 {
+				continue
+			}
+			if p, ok := ParseFrame(ifaces[0].linkType, body[4:]); ok {
+				p.Interface = ifaces[0].name
+				packet(p)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseFrame finds the IP packet in a frame of the given link type
+func ParseFrame(linkType int, b []byte) (CapturedPacket, bool) {
+	var etherType uint16
+	switch linkType {
+	case 0:
+		// BSD loopback, with the address family in host byte order
+		if len(b) < 4 {
+			return CapturedPacket{}, false
+		}
+		return ParseIPPacket(b[4:])
+	case 1:
+		if len(b) < 14 {
+			return CapturedPacket{}, false
+		}
+		etherType, b = binary.BigEndian.Uint16(b[12:]), b[14:]
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(b) >= 4 {
+			etherType, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+	case 101, 228, 229:
+		return ParseIPPacket(b)
+	case 113:
+		if len(b) < 16 {
+			return CapturedPacket{}, false
+		}
+		etherType, b = binary.BigEndian.Uint16(b[14:]), b[16:]
+	case 276:
+		if len(b) < 20 {
+			return CapturedPacket{}, false
+		}
+		etherType, b = binary.BigEndian.Uint16(b), b[20:]
+	default:
+		return CapturedPacket{}, false
+	}
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return CapturedPacket{}, false
+	}
+	return ParseIPPacket(b)
+}
+
+// ParseIPPacket returns the addresses, protocol, and payload of an IPv4 or IPv6 packet, skipping IPv6 extension headers and fragments
+func ParseIPPacket(b []byte) (CapturedPacket, bool) {
+	if len(b) < 1 {
+		return CapturedPacket{}, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return CapturedPacket{}, false
+		}
+		if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return CapturedPacket{}, false
+		}
+		if l := int(binary.BigEndian.Uint16(b[2:])); l >= ihl && l <= len(b) {
+			b = b[:l]
+		}
+		return CapturedPacket{
+			Src:      net.IP(append([]byte{}, b[12:16]...)),
+			Dst:      net.IP(append([]byte{}, b[16:20]...)),
+			Protocol: int(b[9]),
+			TTL:      int(b[8]),
+			Payload:  b[ihl:],
+		}, true
+	case 6:
+		if len(b) < 40 {
+			return CapturedPacket{}, false
+		}
+		if l := 40 + int(binary.BigEndian.Uint16(b[4:])); l <= len(b) {
+			b = b[:l]
+		}
+		z := CapturedPacket{
+			Src: net.IP(append([]byte{}, b[8:24]...)),
+			Dst: net.IP(append([]byte{}, b[24:40]...)),
+			TTL: int(b[7]),
+		}
+		next, payload := int(b[6]), b[40:]
+		for {
+			switch next {
+			case 0, 43, 60:
+				if len(payload) < 2 || len(payload) < (int(payload[1])+1)*8 {
+					return CapturedPacket{}, false
+				}
+				next, payload = int(payload[0]), payload[(int(payload[1])+1)*8:]
+				continue
+			case 51:
+				if len(payload) < 2 || len(payload) < (int(payload[1])+2)*4 {
+					return CapturedPacket{}, false
+				}
+				next, payload = int(payload[0]), payload[(int(payload[1])+2)*4:]
+				continue
+			case 44:
+				return CapturedPacket{}, false
+			}
+			break
+		}
+		z.Protocol, z.Payload = next, payload
+		return z, true
+	}
+	return CapturedPacket{}, false
+}
@@ -0,0 +1,719 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"code.rocketnine.space/tslocum/cview"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PIM message types from RFC 7761 and RFC 5059
+const (
+	PimHello        = 0
+	PimRegister     = 1
+	PimRegisterStop = 2
+	PimJoinPrune    = 3
+	PimBootstrap    = 4
+	PimAssert       = 5
+	PimGraft        = 6
+	PimGraftAck     = 7
+	PimCandidateRP  = 8
+
+	// Assert winners that change this many times within PimFlapWindow are flapping
+	PimAssertTime = 180 * time.Second
+	PimFlapWindow = time.Minute
+	PimFlapCount  = 3
+	PimRecentMax  = 20
+)
+
+var (
+	PimTypeNames = map[int]string{
+		PimHello:        "Hello",
+		PimRegister:     "Register",
+		PimRegisterStop: "Register-Stop",
+		PimJoinPrune:    "Join/Prune",
+		PimBootstrap:    "Bootstrap",
+		PimAssert:       "Assert",
+		PimGraft:        "Graft",
+		PimGraftAck:     "Graft-Ack",
+		PimCandidateRP:  "Candidate-RP-Advertisement",
+	}
+	PimAllRouters4 = net.ParseIP("224.0.0.13")
+	PimAllRouters6 = net.ParseIP("ff02::d")
+
+	// Data, guarded by Mutex
+	PimNeighbors = make(map[string]*PimNeighbor)
+	PimAsserts   = make(map[string]*PimAssertState)
+	PimJoins     = make(map[string]*PimMessage)
+	PimBSRs      = make(map[string]*PimMessage)
+	PimCounts    = make(map[int]int)
+	PimRecent    []string
+
+	Pim = cview.NewTextView()
+)
+
+// PimMessage is a decoded PIM message, with the fields used by its type
+type PimMessage struct {
+	Type      int
+	Time      time.Time
+	Interface string
+	Src       net.IP
+	Dst       net.IP
+
+	// Hello, where Holdtime is also used by Join/Prune
+	Holdtime      int
+	DRPriority    uint32
+	HasDRPriority bool
+	GenID         uint32
+	HasGenID      bool
+	Addresses     []net.IP
+
+	// Join/Prune
+	Upstream net.IP
+	Groups   []PimGroup
+
+	// Assert, Register, and Register-Stop
+	Group      net.IP
+	Source     net.IP
+	RPT        bool
+	Preference uint32
+	Metric     uint32
+	Border     bool
+	Null       bool
+
+	// Bootstrap and Candidate-RP-Advertisement
+	BSR         net.IP
+	BSRPriority int
+	RPs         []net.IP
+}
+
+// PimGroup is one group of a Join/Prune message, or a group range of a Bootstrap message
+type PimGroup struct {
+	Group   net.IP
+	MaskLen int
+	Joins   []net.IP
+	Prunes  []net.IP
+}
+
+// PimNeighbor is a router heard sending Hellos on an interface
+type PimNeighbor struct {
+	Interface     string
+	Addr          net.IP
+	Holdtime      int
+	DRPriority    uint32
+	HasDRPriority bool
+	GenID         uint32
+	HasGenID      bool
+	First         time.Time
+	Last          time.Time
+	Interval      time.Duration
+	Hellos        int
+	Restarts      int
+	Goodbye       bool
+}
+
+// PimAssertState follows the Assert winner for a source and group on an interface
+type PimAssertState struct {
+	Interface  string
+	Group      string
+	Source     string
+	Candidates map[string]*PimMessage
+	Winner     string
+	Changes    []time.Time
+}
+
+// DecodePim decodes a PIM version 2 message
+func DecodePim(b []byte) (*PimMessage, error) {
+	if len(b) < 4 {
+		return nil, errors.New("message is too short")
+	}
+	if b[0]>>4 != 2 {
+		return nil, fmt.Errorf("version %d is not supported", b[0]>>4)
+	}
+	m := &PimMessage{Type: int(b[0] & 0x0f)}
+	b = b[4:]
+
+	var err error
+	switch m.Type {
+	case PimHello:
+		m.Holdtime = -1
+		for len(b) >= 4 {
+			option, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+			if len(b) < 4+l {
+				return nil, errors.New("Hello option is truncated")
+			}
+			value := b[4 : 4+l]
+			switch {
+			case option == 1 && l == 2:
+				m.Holdtime = int(binary.BigEndian.Uint16(value))
+			case option == 19 && l == 4:
+				m.DRPriority, m.HasDRPriority = binary.BigEndian.Uint32(value), true
+			case option == 20 && l == 4:
+				m.GenID, m.HasGenID = binary.BigEndian.Uint32(value), true
+			case option == 24:
+				for len(value) > 0 {
+					var ip net.IP
+					ip, value, err = PimAddress(value, 2)
+					if err != nil {
+						break
+					}
+					m.Addresses = append(m.Addresses, ip)
+				}
+			}
+			b = b[4+l:]
+		}
+		if m.Holdtime == -1 {
+			m.Holdtime = 105
+		}
+	case PimJoinPrune:
+		m.Upstream, b, err = PimAddress(b, 2)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < 4 {
+			return nil, errors.New("Join/Prune is truncated")
+		}
+		n := int(b[1])
+		m.Holdtime = int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		for i := 0; i < n; i++ {
+			var g PimGroup
+			g.Group, g.MaskLen, b, err = PimGroupAddress(b)
+			if err != nil {
+				return nil, err
+			}
+			if len(b) < 4 {
+				return nil, errors.New("Join/Prune group is truncated")
+			}
+			joins, prunes := int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+			b = b[4:]
+			for j := 0; j < joins+prunes; j++ {
+				var source net.IP
+				source, b, err = PimAddress(b, 4)
+				if err != nil {
+					return nil, err
+				}
+				if j < joins {
+					g.Joins = append(g.Joins, source)
+				} else {
+					g.Prunes = append(g.Prunes, source)
+				}
+			}
+			m.Groups = append(m.Groups, g)
+		}
+	case PimAssert:
+		m.Group, b, err = PimAddress(b, 4)
+		if err != nil {
+			return nil, err
+		}
+		m.Source, b, err = PimAddress(b, 2)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < 8 {
+			return nil, errors.New("Assert is truncated")
+		}
+		preference := binary.BigEndian.Uint32(b)
+		m.RPT, m.Preference, m.Metric = preference&0x80000000 != 0, preference&0x7fffffff, binary.BigEndian.Uint32(b[4:])
+	case PimRegister:
+		if len(b) < 4 {
+			return nil, errors.New("Register is truncated")
+		}
+		m.Border, m.Null = b[0]&0x80 != 0, b[0]&0x40 != 0
+		if inner, ok := ParseIPPacket(b[4:]); ok {
+			m.Source, m.Group = inner.Src, inner.Dst
+		}
+	case PimRegisterStop:
+		m.Group, b, err = PimAddress(b, 4)
+		if err != nil {
+			return nil, err
+		}
+		m.Source, _, err = PimAddress(b, 2)
+		if err != nil {
+			return nil, err
+		}
+	case PimBootstrap:
+		if len(b) < 4 {
+			return nil, errors.New("Bootstrap is truncated")
+		}
+		m.BSRPriority = int(b[3])
+		m.BSR, b, err = PimAddress(b[4:], 2)
+		if err != nil {
+			return nil, err
+		}
+		for len(b) > 0 {
+			var g PimGroup
+			g.Group, g.MaskLen, b, err = PimGroupAddress(b)
+			if err != nil || len(b) < 4 {
+				break
+			}
+			count := int(b[1])
+			b = b[4:]
+			for i := 0; i < count; i++ {
+				var rp net.IP
+				rp, b, err = PimAddress(b, 2)
+				if err != nil || len(b) < 4 {
+					break
+				}
+				m.RPs = append(m.RPs, rp)
+				b = b[4:]
+			}
+			m.Groups = append(m.Groups, g)
+		}
+	case PimCandidateRP:
+		if len(b) < 4 {
+			return nil, errors.New("Candidate-RP-Advertisement is truncated")
+		}
+		m.Holdtime = int(binary.BigEndian.Uint16(b[2:]))
+		var rp net.IP
+		rp, _, err = PimAddress(b[4:], 2)
+		if err != nil {
+			return nil, err
+		}
+		m.RPs = []net.IP{rp}
+	}
+	return m, nil
+}
+
+// PimAddress decodes an encoded address, where header is 2 for unicast addresses and 4 for group and source addresses
+func PimAddress(b []byte, header int) (net.IP, []byte, error) {
+	if len(b) < header {
+		return nil, nil, errors.New("encoded address is truncated")
+	}
+	var l int
+	switch b[0] {
+	case 1:
+		l = net.IPv4len
+	case 2:
+		l = net.IPv6len
+	default:
+		return nil, nil, fmt.Errorf("address family %d is not supported", b[0])
+	}
+	if len(b) < header+l {
+		return nil, nil, errors.New("encoded address is truncated")
+	}
+	return net.IP(append([]byte{}, b[header:header+l]...)), b[header+l:], nil
+}
+
+// PimGroupAddress decodes an encoded group address, which has the mask length in the last byte of its header
+func PimGroupAddress(b []byte) (net.IP, int, []byte, error) {
+	group, rest, err := PimAddress(b, 4)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return group, int(b[3]), rest, nil
+}
+
+// StorePim updates the neighbors, Asserts, and recent messages with a received message. Mutex must be held.
+func StorePim(m *PimMessage) {
+	PimCounts[m.Type]++
+	key := m.Interface + " " + m.Src.String()
+	recent := ""
+
+	switch m.Type {
+	case PimHello:
+		n := PimNeighbors[key]
+		if n == nil {
+			n = &PimNeighbor{Interface: m.Interface, Addr: m.Src, First: m.Time}
+			PimNeighbors[key] = n
+			recent = fmt.Sprintf("New neighbor %s on %s", m.Src, m.Interface)
+		} else {
+			n.Interval = m.Time.Sub(n.Last)
+			if m.HasGenID && n.HasGenID && n.GenID != m.GenID {
+				n.Restarts++
+				recent = fmt.Sprintf("Neighbor %s on %s restarted, generation ID changed", m.Src, m.Interface)
+			}
+		}
+		n.Holdtime, n.DRPriority, n.HasDRPriority, n.GenID, n.HasGenID = m.Holdtime, m.DRPriority, m.HasDRPriority, m.GenID, m.HasGenID
+		n.Last = m.Time
+		n.Hellos++
+		n.Goodbye = m.Holdtime == 0
+		if n.Goodbye {
+			recent = fmt.Sprintf("Neighbor %s on %s said goodbye", m.Src, m.Interface)
+		}
+	case PimJoinPrune:
+		PimJoins[key+" "+m.Upstream.String()] = m
+		joins, prunes := 0, 0
+		for _, g := range m.Groups {
+			joins += len(g.Joins)
+			prunes += len(g.Prunes)
+		}
+		recent = fmt.Sprintf("Join/Prune from %s to %s on %s: %d groups, %d joins, %d prunes", m.Src, m.Upstream, m.Interface, len(m.Groups), joins, prunes)
+	case PimAssert:
+		akey := fmt.Sprintf("%s (%s, %s)", m.Interface, m.Source, m.Group)
+		a := PimAsserts[akey]
+		if a == nil {
+			a = &PimAssertState{Interface: m.Interface, Group: m.Group.String(), Source: m.Source.String(), Candidates: make(map[string]*PimMessage)}
+			PimAsserts[akey] = a
+		}
+		if m.Preference == 0x7fffffff && m.Metric == 0xffffffff {
+			delete(a.Candidates, m.Src.String())
+			recent = fmt.Sprintf("AssertCancel from %s for %s", m.Src, akey)
+		} else {
+			a.Candidates[m.Src.String()] = m
+			recent = fmt.Sprintf("Assert from %s for %s: preference %d metric %d", m.Src, akey, m.Preference, m.Metric)
+		}
+		var winner *PimMessage
+		for _, c := range a.Candidates {
+			if m.Time.Sub(c.Time) <= PimAssertTime && (winner == nil || PimAssertBetter(c, winner)) {
+				winner = c
+			}
+		}
+		if winner != nil && winner.Src.String() != a.Winner {
+			if a.Winner != "" {
+				a.Changes = append(a.Changes, m.Time)
+			}
+			a.Winner = winner.Src.String()
+		}
+	case PimRegister:
+		recent = fmt.Sprintf("Register from %s to RP %s for (%s, %s)", m.Src, m.Dst, m.Source, m.Group)
+		if m.Null {
+			recent = fmt.Sprintf("Null-Register from %s to RP %s for (%s, %s)", m.Src, m.Dst, m.Source, m.Group)
+		}
+	case PimRegisterStop:
+		recent = fmt.Sprintf("Register-Stop from RP %s to %s for (%s, %s)", m.Src, m.Dst, m.Source, m.Group)
+	case PimBootstrap:
+		if PimBSRs[m.BSR.String()] == nil {
+			recent = fmt.Sprintf("Bootstrap router %s priority %d with %d RPs", m.BSR, m.BSRPriority, len(m.RPs))
+		}
+		PimBSRs[m.BSR.String()] = m
+	case PimCandidateRP:
+		recent = fmt.Sprintf("Candidate RP %s advertised to %s", m.RPs[0], m.Dst)
+	}
+
+	if recent != "" {
+		PimRecent = append(PimRecent, m.Time.Format("01-02 15:04:05")+" "+recent)
+		if len(PimRecent) > PimRecentMax {
+			PimRecent = PimRecent[len(PimRecent)-PimRecentMax:]
+		}
+	}
+}
+
+// Live reports whether the neighbor's last Hello is still within its holdtime, where 65535 never expires
+func (n *PimNeighbor) Live(now time.Time) bool {
+	if n.Goodbye {
+		return false
+	}
+	return n.Holdtime == 0xffff || now.Sub(n.Last) <= time.Duration(n.Holdtime)*time.Second
+}
+
+// PimAssertBetter reports whether Assert a beats b, preferring SPT over RPT, then lower preference, lower metric, and higher address
+func PimAssertBetter(a *PimMessage, b *PimMessage) bool {
+	if a.RPT != b.RPT {
+		return !a.RPT
+	}
+	if a.Preference != b.Preference {
+		return a.Preference < b.Preference
+	}
+	if a.Metric != b.Metric {
+		return a.Metric < b.Metric
+	}
+	return bytes.Compare(a.Src.To16(), b.Src.To16()) > 0
+}
+
+// PimInterfaces returns the live neighbors on each interface, by interface name. Mutex must be held.
+func PimInterfaces(now time.Time) map[string][]*PimNeighbor {
+	z := make(map[string][]*PimNeighbor)
+	for _, n := range PimNeighbors {
+		if n.Live(now) {
+			z[n.Interface] = append(z[n.Interface], n)
+		}
+	}
+	for _, neighbors := range z {
+		sort.Slice(neighbors, func(i, j int) bool { return bytes.Compare(neighbors[i].Addr.To16(), neighbors[j].Addr.To16()) < 0 })
+	}
+	return z
+}
+
+// PimDR returns the elected DR among neighbors, using DR priority only if every neighbor sends one
+func PimDR(neighbors []*PimNeighbor) *PimNeighbor {
+	usePriority := true
+	for _, n := range neighbors {
+		if !n.HasDRPriority {
+			usePriority = false
+		}
+	}
+	var dr *PimNeighbor
+	for _, n := range neighbors {
+		switch {
+		case dr == nil:
+			dr = n
+		case usePriority && n.DRPriority != dr.DRPriority:
+			if n.DRPriority > dr.DRPriority {
+				dr = n
+			}
+		case bytes.Compare(n.Addr.To16(), dr.Addr.To16()) > 0:
+			dr = n
+		}
+	}
+	return dr
+}
+
+// PimProblems returns the common PIM problems seen so far. Mutex must be held.
+func PimProblems(now time.Time) (z []string) {
+	ifaces := PimInterfaces(now)
+	var names []string
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		neighbors := ifaces[name]
+		if len(neighbors) < 2 {
+			continue
+		}
+
+		// DR election, where ties broken by address are normal, as when every router keeps the default priority
+		var silent []string
+		for _, n := range neighbors {
+			if !n.HasDRPriority {
+				silent = append(silent, n.Addr.String())
+			}
+		}
+		if len(silent) > 0 {
+			z = append(z, fmt.Sprintf("DR on %s is elected by address because %s send no DR priority", name, strings.Join(silent, ", ")))
+		}
+
+		// Hello intervals and holdtimes
+		holdtimes := make(map[int]bool)
+		var desc []string
+		var shortest, longest time.Duration
+		for _, n := range neighbors {
+			holdtimes[n.Holdtime] = true
+			desc = append(desc, fmt.Sprintf("%s holdtime %ds interval %s", n.Addr, n.Holdtime, n.Interval.Round(time.Second)))
+			if n.Interval > 0 && (shortest == 0 || n.Interval < shortest) {
+				shortest = n.Interval
+			}
+			if n.Interval > longest {
+				longest = n.Interval
+			}
+		}
+		if len(holdtimes) > 1 || (shortest > 0 && longest-shortest > time.Second && longest > shortest*3/2) {
+			z = append(z, fmt.Sprintf("Hello interval mismatch on %s: %s", name, strings.Join(desc, ", ")))
+		}
+	}
+
+	// Neighbors that went away
+	var keys []string
+	for key := range PimNeighbors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		n := PimNeighbors[key]
+		switch {
+		case n.Goodbye:
+			z = append(z, fmt.Sprintf("Missing neighbor %s on %s, which said goodbye %s ago", n.Addr, n.Interface, now.Sub(n.Last).Round(time.Second)))
+		case !n.Live(now):
+			z = append(z, fmt.Sprintf("Missing neighbor %s on %s, no Hello for %s with holdtime %ds", n.Addr, n.Interface, now.Sub(n.Last).Round(time.Second), n.Holdtime))
+		}
+		if n.Restarts > 0 {
+			z = append(z, fmt.Sprintf("Neighbor %s on %s restarted %d times", n.Addr, n.Interface, n.Restarts))
+		}
+	}
+
+	// Join/Prunes sent to routers that are not neighbors, as happens with RPF toward the wrong router
+	keys = nil
+	for key := range PimJoins {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m := PimJoins[key]
+		if now.Sub(m.Time) > time.Duration(m.Holdtime)*time.Second {
+			continue
+		}
+		n := PimNeighbors[m.Interface+" "+m.Upstream.String()]
+		if n == nil || !n.Live(now) {
+			z = append(z, fmt.Sprintf("Missing neighbor %s on %s, which %s sends Join/Prunes to", m.Upstream, m.Interface, m.Src))
+		}
+	}
+
+	// Assert winners that keep changing
+	keys = nil
+	for key := range PimAsserts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		changes := 0
+		for _, t := range PimAsserts[key].Changes {
+			if now.Sub(t) <= PimFlapWindow {
+				changes++
+			}
+		}
+		if changes >= PimFlapCount {
+			z = append(z, fmt.Sprintf("Asserts flapping for %s: winner changed %d times in the last %s", key, changes, PimFlapWindow))
+		}
+	}
+	return z
+}
+
+// PimSummary describes the PIM routers, Asserts, bootstrap routers, problems, and recent messages seen. Mutex must be held.
+func PimSummary(now time.Time) string {
+	var b strings.Builder
+
+	var types []int
+	for t := range PimCounts {
+		types = append(types, t)
+	}
+	sort.Ints(types)
+	b.WriteString("Messages:")
+	if len(types) == 0 {
+		b.WriteString(" none")
+	}
+	for _, t := range types {
+		name := PimTypeNames[t]
+		if name == "" {
+			name = fmt.Sprintf("Type %d", t)
+		}
+		fmt.Fprintf(&b, " %s %d", name, PimCounts[t])
+	}
+	b.WriteString("\n")
+
+	ifaces := PimInterfaces(now)
+	var names []string
+	for name := range ifaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dr := PimDR(ifaces[name])
+		fmt.Fprintf(&b, "\nNeighbors on %s\n", name)
+		fmt.Fprintf(&b, "  %-40s %-11s %-8s %-8s %-10s %s\n", "Address", "DR priority", "Holdtime", "Interval", "Last Hello", "Generation ID")
+		for _, n := range ifaces[name] {
+			addr := n.Addr.String()
+			if n == dr {
+				addr += " (DR)"
+			}
+			priority := "none"
+			if n.HasDRPriority {
+				priority = fmt.Sprint(n.DRPriority)
+			}
+			fmt.Fprintf(&b, "  %-40s %-11s %-8s %-8s %-10s %08x\n", addr, priority, fmt.Sprintf("%ds", n.Holdtime), n.Interval.Round(time.Second), now.Sub(n.Last).Round(time.Second), n.GenID)
+		}
+	}
+
+	if len(PimAsserts) > 0 {
+		b.WriteString("\nAsserts\n")
+		var keys []string
+		for key := range PimAsserts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			a := PimAsserts[key]
+			fmt.Fprintf(&b, "  %s winner %s, changed %d times\n", key, a.Winner, len(a.Changes))
+		}
+	}
+
+	if len(PimBSRs) > 0 {
+		b.WriteString("\nBootstrap routers\n")
+		var keys []string
+		for key := range PimBSRs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			m := PimBSRs[key]
+			var rps, groups []string
+			for _, rp := range m.RPs {
+				rps = append(rps, rp.String())
+			}
+			for _, g := range m.Groups {
+				groups = append(groups, fmt.Sprintf("%s/%d", g.Group, g.MaskLen))
+			}
+			fmt.Fprintf(&b, "  %s priority %d, groups %s, RPs %s, last %s ago\n", key, m.BSRPriority, strings.Join(groups, " "), strings.Join(rps, " "), now.Sub(m.Time).Round(time.Second))
+		}
+	}
+
+	b.WriteString("\nProblems\n")
+	problems := PimProblems(now)
+	if len(problems) == 0 {
+		b.WriteString("  None found\n")
+	}
+	for _, p := range problems {
+		fmt.Fprintf(&b, "  %s\n", p)
+	}
+
+	if len(PimRecent) > 0 {
+		b.WriteString("\nRecent messages\n")
+		for _, r := range PimRecent {
+			fmt.Fprintf(&b, "  %s\n", r)
+		}
+	}
+	return b.String()
+}
+
+// HandlePim decodes and stores a PIM packet from a raw socket or capture file
+func HandlePim(p CapturedPacket) {
+	m, err := DecodePim(p.Payload)
+	if err != nil {
+		Debug("PIM: %s from %s on %s: %v", p.Dst, p.Src, p.Interface, err)
+		return
+	}
+	m.Time, m.Interface, m.Src, m.Dst = p.Time, p.Interface, p.Src, p.Dst
+	Mutex.Lock()
+	StorePim(m)
+	Mutex.Unlock()
+}
+
+// MakePim listens for PIM on the usable interfaces, joining ALL-PIM-ROUTERS so Hellos are received
+func MakePim(ifaces []net.Interface) {
+	group := PimAllRouters4
+	if Transport == "udp6" {
+		group = PimAllRouters6
+	}
+	MakeRawSocket("PIM", 103, []net.IP{group}, HandlePim)
+	if s := RawSockets["PIM"]; s != nil {
+		s.Join(ifaces)
+	}
+}
+
+// AnalyzePimFile prints what the PIM packets in a capture file show, as of the last packet
+func AnalyzePimFile(path string) error {
+	var last time.Time
+	err := ReadCaptureFile(path, func(p CapturedPacket) {
+		if p.Protocol != 103 {
+			return
+		}
+		HandlePim(p)
+		if p.Time.After(last) {
+			last = p.Time
+		}
+	})
+	if err != nil {
+		return err
+	}
+	Mutex.Lock()
+	fmt.Print(PimSummary(last))
+	Mutex.Unlock()
+	return nil
+}
+
+func UpdatePim() {
+	Mutex.Lock()
+	text := PimSummary(Now())
+	Mutex.Unlock()
+	Pim.SetText(cview.Escape(text))
+}
@@ -0,0 +1,270 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// PIM messages assembled by hand from the formats in RFC 7761, without the IP header and with zero checksums
+var (
+	// Hello with holdtime 105, DR priority 10, a generation ID, and secondary address 10.0.1.1
+	HelloPacket1 = "2000 0000 0001 0002 0069 0013 0004 0000000a 0014 0004 12345678 0018 0006 0100 0a000101"
+	// Hello with the same holdtime and DR priority and another generation ID
+	HelloPacket2 = "2000 0000 0001 0002 0069 0013 0004 0000000a 0014 0004 9abcdef0"
+	// Hello with only a holdtime, as from a router that sends no DR priority
+	HelloPacket3 = "2000 0000 0001 0002 0069"
+	// Join/Prune to upstream 10.0.0.3 with holdtime 210, joining (192.0.2.1, 239.1.1.1)
+	JoinPacket = "2300 0000 0100 0a000003 0001 00d2 0100 0020 ef010101 0001 0000 0100 0720 c0000201"
+	// Assert for (192.0.2.1, 239.1.1.1) with preference 120 and metric 10
+	AssertPacket = "2500 0000 0100 0020 ef010101 0100 c0000201 00000078 0000000a"
+)
+
+// Hex decodes a packet written as hex with spaces between fields
+func Hex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// IPv4Packet wraps payload in an IPv4 header for a capture file
+func IPv4Packet(src string, dst string, protocol uint8, payload []byte) []byte {
+	z := []byte{0x45, 0}
+	z = binary.BigEndian.AppendUint16(z, uint16(20+len(payload)))
+	z = append(z, 0, 0, 0, 0, 1, protocol, 0, 0)
+	z = append(z, net.ParseIP(src).To4()...)
+	z = append(z, net.ParseIP(dst).To4()...)
+	return append(z, payload...)
+}
+
+// Pcapng returns a pcapng file of raw IP packets, one second apart
+func Pcapng(packets ...[]byte) []byte {
+	b := PcapBlock(0x0a0d0d0a, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil)
+	idb := binary.LittleEndian.AppendUint16(nil, PcapLinkTypeRaw)
+	idb = append(idb, 0, 0, 0, 0, 0, 0)
+	b = append(b, PcapBlock(1, idb, [][]byte{PcapOption(2, []byte("eth0"))})...)
+	for i, packet := range packets {
+		ts := uint64(time.Unix(1700000000+int64(i), 0).UnixMicro())
+		epb := binary.LittleEndian.AppendUint32(nil, 0)
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts>>32))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(ts))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(packet)))
+		b = append(b, PcapBlock(6, append(epb, packet...), nil)...)
+	}
+	return b
+}
+
+// ReadCapture writes b to a file and reads the packets in it back
+func ReadCapture(t *testing.T, b []byte) ([]CapturedPacket, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "capture.pcapng")
+	err := os.WriteFile(path, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var z []CapturedPacket
+	err = ReadCaptureFile(path, func(p CapturedPacket) { z = append(z, p) })
+	return z, err
+}
+
+func ResetPim() {
+	PimNeighbors = make(map[string]*PimNeighbor)
+	PimAsserts = make(map[string]*PimAssertState)
+	PimJoins = make(map[string]*PimMessage)
+	PimBSRs = make(map[string]*PimMessage)
+	PimCounts = make(map[int]int)
+	PimRecent = nil
+}
+
+// StoreTestPim decodes and stores a message as if it arrived on eth0
+func StoreTestPim(t *testing.T, packet string, src string, at time.Time) {
+	t.Helper()
+	m, err := DecodePim(Hex(t, packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Time, m.Interface, m.Src, m.Dst = at, "eth0", net.ParseIP(src), PimAllRouters4
+	StorePim(m)
+}
+
+func TestDecodePim(t *testing.T) {
+	m, err := DecodePim(Hex(t, HelloPacket1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != PimHello || m.Holdtime != 105 || !m.HasDRPriority || m.DRPriority != 10 || !m.HasGenID || m.GenID != 0x12345678 {
+		t.Errorf("Hello = %+v", m)
+	}
+	if len(m.Addresses) != 1 || !m.Addresses[0].Equal(net.ParseIP("10.0.1.1")) {
+		t.Errorf("Hello addresses = %v, want [10.0.1.1]", m.Addresses)
+	}
+
+	m, err = DecodePim(Hex(t, JoinPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != PimJoinPrune || !m.Upstream.Equal(net.ParseIP("10.0.0.3")) || m.Holdtime != 210 || len(m.Groups) != 1 {
+		t.Fatalf("Join/Prune = %+v", m)
+	}
+	g := m.Groups[0]
+	if !g.Group.Equal(net.ParseIP("239.1.1.1")) || g.MaskLen != 32 || len(g.Joins) != 1 || !g.Joins[0].Equal(net.ParseIP("192.0.2.1")) || len(g.Prunes) != 0 {
+		t.Errorf("Join/Prune group = %+v", g)
+	}
+
+	m, err = DecodePim(Hex(t, AssertPacket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != PimAssert || !m.Group.Equal(net.ParseIP("239.1.1.1")) || !m.Source.Equal(net.ParseIP("192.0.2.1")) || m.RPT || m.Preference != 120 || m.Metric != 10 {
+		t.Errorf("Assert = %+v", m)
+	}
+
+	if _, err := DecodePim(Hex(t, "1000 0000")); err == nil {
+		t.Error("DecodePim of version 1 succeeded")
+	}
+}
+
+func TestDecodePimTruncated(t *testing.T) {
+	for _, packet := range []string{HelloPacket1, JoinPacket, AssertPacket} {
+		b := Hex(t, packet)
+		for n := 0; n < len(b); n++ {
+			m, err := DecodePim(b[:n])
+			if n < 4 && err == nil {
+				t.Errorf("DecodePim of %d bytes of %s succeeded", n, packet)
+			}
+			if b[0]&0x0f != PimHello && err == nil {
+				t.Errorf("DecodePim of %d bytes of %s = %+v, want an error", n, packet, m)
+			}
+		}
+	}
+}
+
+func TestPimDR(t *testing.T) {
+	neighbor := func(addr string, priority uint32, has bool) *PimNeighbor {
+		return &PimNeighbor{Addr: net.ParseIP(addr), DRPriority: priority, HasDRPriority: has}
+	}
+	for _, c := range []struct {
+		neighbors []*PimNeighbor
+		want      string
+	}{
+		{[]*PimNeighbor{neighbor("10.0.0.1", 1, true), neighbor("10.0.0.2", 5, true)}, "10.0.0.2"},
+		{[]*PimNeighbor{neighbor("10.0.0.3", 5, true), neighbor("10.0.0.2", 1, true)}, "10.0.0.3"},
+		{[]*PimNeighbor{neighbor("10.0.0.1", 9, true), neighbor("10.0.0.2", 1, true), neighbor("10.0.0.3", 9, true)}, "10.0.0.3"},
+		{[]*PimNeighbor{neighbor("10.0.0.1", 9, true), neighbor("10.0.0.2", 0, false)}, "10.0.0.2"},
+	} {
+		if dr := PimDR(c.neighbors); dr.Addr.String() != c.want {
+			t.Errorf("PimDR = %s, want %s", dr.Addr, c.want)
+		}
+	}
+}
+
+func TestPimProblems(t *testing.T) {
+	defer ResetPim()
+	ResetPim()
+	t0 := time.Unix(1700000000, 0)
+	StoreTestPim(t, HelloPacket1, "10.0.0.1", t0)
+	StoreTestPim(t, HelloPacket2, "10.0.0.2", t0)
+	StoreTestPim(t, JoinPacket, "10.0.0.1", t0)
+
+	// A priority tie broken by address is normal
+	problems := strings.Join(PimProblems(t0.Add(time.Second)), "\n")
+	if want := "Missing neighbor 10.0.0.3 on eth0, which 10.0.0.1 sends Join/Prunes to"; !strings.Contains(problems, want) {
+		t.Errorf("PimProblems = %q, want %q", problems, want)
+	}
+	if strings.Contains(problems, "DR") {
+		t.Errorf("PimProblems = %q, want no DR problems for a priority tie", problems)
+	}
+
+	// A neighbor without a DR priority, then neighbors that expire
+	StoreTestPim(t, HelloPacket3, "10.0.0.4", t0.Add(10*time.Second))
+	problems = strings.Join(PimProblems(t0.Add(20*time.Second)), "\n")
+	if want := "DR on eth0 is elected by address because 10.0.0.4 send no DR priority"; !strings.Contains(problems, want) {
+		t.Errorf("PimProblems = %q, want %q", problems, want)
+	}
+	problems = strings.Join(PimProblems(t0.Add(200*time.Second)), "\n")
+	if want := "Missing neighbor 10.0.0.1 on eth0, no Hello for 3m20s with holdtime 105s"; !strings.Contains(problems, want) {
+		t.Errorf("PimProblems = %q, want %q", problems, want)
+	}
+
+	// Assert winners that change every few seconds
+	for i, c := range []struct {
+		src        string
+		preference uint32
+	}{{"10.0.0.1", 100}, {"10.0.0.2", 50}, {"10.0.0.1", 10}, {"10.0.0.2", 5}} {
+		b := Hex(t, AssertPacket)
+		binary.BigEndian.PutUint32(b[len(b)-8:], c.preference)
+		m, err := DecodePim(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Time, m.Interface, m.Src = t0.Add(time.Duration(i)*time.Second), "eth0", net.ParseIP(c.src)
+		StorePim(m)
+	}
+	problems = strings.Join(PimProblems(t0.Add(5*time.Second)), "\n")
+	if want := "Asserts flapping for eth0 (192.0.2.1, 239.1.1.1): winner changed 3 times"; !strings.Contains(problems, want) {
+		t.Errorf("PimProblems = %q, want %q", problems, want)
+	}
+}
+
+func TestReadCaptureFile(t *testing.T) {
+	b := Pcapng(IPv4Packet("10.0.0.1", "224.0.0.13", 103, Hex(t, HelloPacket1)), IPv4Packet("10.0.0.1", "10.0.0.3", 103, Hex(t, JoinPacket)))
+	packets, err := ReadCapture(t, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("ReadCaptureFile found %d packets, want 2", len(packets))
+	}
+	p := packets[0]
+	if p.Protocol != 103 || p.Interface != "eth0" || !p.Src.Equal(net.ParseIP("10.0.0.1")) || !p.Dst.Equal(PimAllRouters4) || !p.Time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("packet = %+v", p)
+	}
+	if _, err := DecodePim(p.Payload); err != nil {
+		t.Errorf("DecodePim: %v", err)
+	}
+
+	// Truncated files end early without panicking
+	for n := 0; n < len(b); n++ {
+		packets, _ := ReadCapture(t, b[:n])
+		if len(packets) > 2 {
+			t.Fatalf("ReadCaptureFile of %d bytes found %d packets", n, len(packets))
+		}
+	}
+}
+
+func TestReadCaptureFileUnpaddedOption(t *testing.T) {
+	// An interface name of one byte as the last option, without the padding after it
+	b := PcapBlock(0x0a0d0d0a, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil)
+	body := []byte{PcapLinkTypeRaw, 0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 0, 'x'}
+	idb := binary.LittleEndian.AppendUint32(nil, 1)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(12+len(body)))
+	idb = append(idb, body...)
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(12+len(body)))
+	b = append(b, idb...)
+	if _, err := ReadCapture(t, b); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.rocketnine.space/tslocum/cview"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Asymmetry is a pair of hosts where Hearer receives Source but Source does not receive Hearer
+type Asymmetry struct {
+	Hearer string
+	Source string
+}
+
+// HeardAge returns the time since host last heard ip, or 0 if host has never heard it. Mutex must be held.
+func HeardAge(host string, ip string, now time.Time) time.Duration {
+	if host == Host && Role != "collector" {
+		t := HeardIPs[ip]
+		if t.IsZero() {
+			return 0
+		}
+		return now.Sub(t)
+	}
+	d := HeardDb[host][ip]
+	if d != 0 {
+		d += now.Sub(HeardHosts[host])
+	}
+	return d
+}
+
+// HostAddrs groups the known IPs by the host they belong to. Mutex must be held.
+func HostAddrs() map[string][]string {
+	addrs := make(map[string][]string)
+	for ip, host := range HostIPs {
+		addrs[host] = append(addrs[host], ip)
+	}
+	if Role != "collector" {
+		addrs[Host] = nil
+		for _, s := range Senders {
+			addrs[Host] = append(addrs[Host], s.IP.String())
+		}
+	}
+	for host := range addrs {
+		sort.Strings(addrs[host])
+	}
+	return addrs
+}
+
+// Hears reports whether host has heard any of ips within the Stale interval. Mutex must be held.
+func Hears(host string, ips []string, now time.Time) bool {
+	for _, ip := range ips {
+		if d := HeardAge(host, ip, now); d != 0 && d < Stale {
+			return true
+		}
+	}
+	return false
+}
+
+// CanHear reports whether host receives multicast and reports what it hears. Mutex must be held.
+func CanHear(host string) bool {
+	if host == Host && Role != "collector" {
+		return Role != "beacon"
+	}
+	_, ok := HeardDb[host]
+	return ok && !Beacons[host]
+}
+
+// FindAsymmetric returns every pair of hosts where only one direction works. Mutex must be held.
+func FindAsymmetric(now time.Time) (z []Asymmetry) {
+	addrs := HostAddrs()
+	var hosts []string
+	for host := range addrs {
+		if CanHear(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	for i, a := range hosts {
+		for _, b := range hosts[i+1:] {
+			ab := Hears(a, addrs[b], now)
+			ba := Hears(b, addrs[a], now)
+			switch {
+			case ab && !ba:
+				z = append(z, Asymmetry{Hearer: a, Source: b})
+			case ba && !ab:
+				z = append(z, Asymmetry{Hearer: b, Source: a})
+			}
+		}
+	}
+	return z
+}
+
+func UpdateProblems() {
+	Mutex.Lock()
+	now := Now()
+	asym := FindAsymmetric(now)
+	addrs := HostAddrs()
+	var pim []string
+	if PimEnabled {
+		pim = PimProblems(now)
+	}
+	var igmp []string
+	if IgmpEnabled {
+		igmp = IgmpProblems(now)
+	}
+	Mutex.Unlock()
+
+	var b strings.Builder
+	if len(asym) == 0 && len(pim) == 0 && len(igmp) == 0 {
+		b.WriteString("No problems found\n")
+	}
+	for _, a := range asym {
+		fmt.Fprintf(&b, "[red]ASYMMETRIC[white] %s hears %s but %s does not hear %s\n", a.Hearer, a.Source, a.Source, a.Hearer)
+		fmt.Fprintf(&b, "    %s IPs: %s\n", a.Hearer, strings.Join(addrs[a.Hearer], ", "))
+		fmt.Fprintf(&b, "    %s IPs: %s\n", a.Source, strings.Join(addrs[a.Source], ", "))
+	}
+	for _, p := range pim {
+		fmt.Fprintf(&b, "[red]PIM[white] %s\n", cview.Escape(p))
+	}
+	for _, p := range igmp {
+		fmt.Fprintf(&b, "[red]IGMP[white] %s\n", cview.Escape(p))
+	}
+	Problems.SetText(b.String())
+}
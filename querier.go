@@ -0,0 +1,308 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Last Member Query Interval in tenths of a second, as sent in group-specific queries
+	IgmpLastMemberResp = 10
+)
+
+var (
+	IgmpAllHosts4 = net.ParseIP("224.0.0.1")
+	IgmpAllHosts6 = net.ParseIP("ff02::1")
+
+	// RFC 3376 and RFC 3810 require Router Alert on queries, and snooping switches that check for it drop queries without it.
+	// RouterAlert4 is the IPv4 option, and RouterAlert6 a Hop-by-Hop Options header holding the MLD Router Alert padded to 8 bytes, whose next header the kernel fills in.
+	RouterAlert4 = []byte{0x94, 0x04, 0, 0}
+	RouterAlert6 = []byte{0, 0, 5, 2, 0, 0, 1, 0}
+
+	// Data, guarded by Mutex
+	Querying = make(map[string]*QuerierState)
+)
+
+// QuerierState is the built-in querier on one interface
+type QuerierState struct {
+	Interface string
+	Addr      net.IP
+	Active    bool
+	Backoff   net.IP
+	Startup   int
+	Next      time.Time
+	Sent      int
+	Leaves    map[string]time.Time
+	Pending   map[string]int
+	Err       error
+}
+
+// QuerierAddr returns the address the interface sends queries from, which is the lowest IPv4 address or the IPv6 link-local address as queriers are elected by it
+func QuerierAddr(iface net.Interface) (z net.IP) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			continue
+		}
+		if Transport == "udp6" && (ip.To4() != nil || !ip.IsLinkLocalUnicast()) {
+			continue
+		}
+		if Transport != "udp6" && ip.To4() == nil {
+			continue
+		}
+		if z == nil || bytes.Compare(ip.To16(), z.To16()) < 0 {
+			z = ip
+		}
+	}
+	return z
+}
+
+// LowerQuerier returns a live querier on the interface with a lower address than ours, which wins the election. Mutex must be held.
+func LowerQuerier(iface net.Interface, own net.IP, now time.Time) net.IP {
+	local := make(map[string]bool)
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err == nil {
+			local[ip.String()] = true
+		}
+	}
+	var z net.IP
+	for _, q := range IgmpQueriers {
+		if q.Interface != iface.Name || local[q.Addr.String()] || now.Sub(q.Last) > q.OtherQuerierPresent() {
+			continue
+		}
+		if bytes.Compare(q.Addr.To16(), own.To16()) < 0 && (z == nil || bytes.Compare(q.Addr.To16(), z.To16()) < 0) {
+			z = q.Addr
+		}
+	}
+	return z
+}
+
+// MakeQuery builds a general query, or a group-specific query if group is given, in the version configured for the transport
+func MakeQuery(group net.IP) []byte {
+	general := group == nil
+	if Transport == "udp6" {
+		// The kernel fills in the ICMPv6 checksum
+		b := make([]byte, 28)
+		b[0] = MldQuery
+		binary.BigEndian.PutUint16(b[4:], IgmpLastMemberResp*100)
+		if general {
+			binary.BigEndian.PutUint16(b[4:], 10000)
+		} else {
+			copy(b[8:], group.To16())
+		}
+		b[24], b[25] = IgmpRobustness, byte(IgmpQueryInterval/time.Second)
+		return b
+	}
+
+	b := make([]byte, 8, 12)
+	b[0], b[1] = IgmpQuery, IgmpLastMemberResp
+	if general {
+		b[1] = 100
+	} else {
+		copy(b[4:], group.To4())
+	}
+	if QueryVersion == 3 {
+		b = append(b, IgmpRobustness, byte(IgmpQueryInterval/time.Second), 0, 0)
+	}
+	binary.BigEndian.PutUint16(b[2:], Checksum(b))
+	return b
+}
+
+// SetRouterAlert makes every packet the socket sends carry Router Alert
+func (s *RawSocket) SetRouterAlert() {
+	c, ok := s.Conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		Warn("%s: Conn.SyscallConn: %v", s.Name, err)
+		return
+	}
+	err = rawConn.Control(func(fd uintptr) {
+		if s.Conn6 != nil {
+			SetRouterAlert6(fd)
+		} else {
+			SetRouterAlert4(fd)
+		}
+	})
+	if err != nil {
+		Warn("%s: rawConn.Control: %v", s.Name, err)
+	}
+}
+
+// SendQuery sends a query out of an interface with a TTL of 1
+func SendQuery(s *RawSocket, iface net.Interface, group net.IP) error {
+	dst := group
+	if group == nil {
+		dst = IgmpAllHosts4
+		if Transport == "udp6" {
+			dst = IgmpAllHosts6
+		}
+	}
+	b := MakeQuery(group)
+	a := &net.IPAddr{IP: dst}
+	switch {
+	case s.Conn4 != nil:
+		err := s.Conn4.SetMulticastInterface(&iface)
+		if err != nil {
+			return fmt.Errorf("Conn4.SetMulticastInterface(%s): %v", iface.Name, err)
+		}
+		err = s.Conn4.SetMulticastTTL(1)
+		if err != nil {
+			return fmt.Errorf("Conn4.SetMulticastTTL(1): %v", err)
+		}
+		_, err = s.Conn4.WriteTo(b, nil, a)
+		if err != nil {
+			return fmt.Errorf("Conn4.WriteTo(%s): %v", dst, err)
+		}
+	case s.Conn6 != nil:
+		err := s.Conn6.SetMulticastInterface(&iface)
+		if err != nil {
+			return fmt.Errorf("Conn6.SetMulticastInterface(%s): %v", iface.Name, err)
+		}
+		err = s.Conn6.SetMulticastHopLimit(1)
+		if err != nil {
+			return fmt.Errorf("Conn6.SetMulticastHopLimit(1): %v", err)
+		}
+		_, err = s.Conn6.WriteTo(b, nil, a)
+		if err != nil {
+			return fmt.Errorf("Conn6.WriteTo(%s): %v", dst, err)
+		}
+	}
+	return nil
+}
+
+// SendQueries sends general queries on the interfaces matching QuerierFilter unless a querier with a lower address is present, and group-specific queries after each leave
+func SendQueries(ifaces []net.Interface) {
+	s := RawSockets["IGMP"]
+	if s == nil {
+		return
+	}
+	now := Now()
+	for _, iface := range ifaces {
+		match, err := QuerierFilter.MatchString(iface.Name)
+		if err != nil || !match {
+			continue
+		}
+		own := QuerierAddr(iface)
+		if own == nil {
+			continue
+		}
+
+		Mutex.Lock()
+		q := Querying[iface.Name]
+		if q == nil {
+			q = &QuerierState{Interface: iface.Name, Leaves: make(map[string]time.Time), Pending: make(map[string]int)}
+			Querying[iface.Name] = q
+		}
+		q.Addr = own
+		lower := LowerQuerier(iface, own, now)
+		stopped, started := lower != nil && q.Active, lower == nil && !q.Active
+		if started {
+			q.Startup, q.Next = 0, now
+		}
+		q.Active, q.Backoff = lower == nil, lower
+
+		// Each leave is followed by Robustness group-specific queries, one per second
+		for _, m := range IgmpMembers {
+			if m.Interface == iface.Name && m.Left && m.Last.After(q.Leaves[m.Group.String()]) {
+				q.Leaves[m.Group.String()] = m.Last
+				q.Pending[m.Group.String()] = IgmpRobustness
+			}
+		}
+		var groups []net.IP
+		for group, n := range q.Pending {
+			if n > 0 && q.Active {
+				groups = append(groups, net.ParseIP(group))
+				q.Pending[group] = n - 1
+			}
+		}
+		general := q.Active && !now.Before(q.Next)
+		if general {
+			// Startup queries are sent at a quarter of the interval
+			q.Startup++
+			q.Next = now.Add(IgmpQueryInterval)
+			if q.Startup <= IgmpRobustness {
+				q.Next = now.Add(IgmpQueryInterval / 4)
+			}
+		}
+		Mutex.Unlock()
+
+		if stopped {
+			Event(LevelInfo, Attrs{"event": "querier_stop", "interface": iface.Name, "querier": lower.String()}, "Querier: %s has a lower address on %s, stopping", lower, iface.Name)
+		}
+		if started {
+			Event(LevelInfo, Attrs{"event": "querier_start", "interface": iface.Name, "address": own.String()}, "Querier: querying on %s from %s", iface.Name, own)
+		}
+		if general {
+			groups = append(groups, nil)
+		}
+		for _, group := range groups {
+			err = SendQuery(s, iface, group)
+			Mutex.Lock()
+			changed := err != nil && (q.Err == nil || q.Err.Error() != err.Error())
+			if err == nil {
+				q.Sent++
+			}
+			q.Err = err
+			Mutex.Unlock()
+			if changed {
+				Warn("Querier: %s: %v", iface.Name, err)
+			}
+		}
+	}
+}
+
+// QuerierSummary describes the built-in querier on each interface. Mutex must be held.
+func QuerierSummary() string {
+	var names []string
+	for name := range Querying {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Built-in querier\n")
+	if len(names) == 0 {
+		b.WriteString("  No interfaces match\n")
+	}
+	for _, name := range names {
+		q := Querying[name]
+		state := "querying"
+		if !q.Active {
+			state = fmt.Sprintf("backing off to %s", q.Backoff)
+		}
+		if q.Err != nil {
+			state = fmt.Sprintf("error: %v", q.Err)
+		}
+		fmt.Fprintf(&b, "  %-16s %-40s %d sent, %s\n", name, q.Addr, q.Sent, state)
+	}
+	return b.String()
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// QuerySocket returns a raw socket for queries with Router Alert set, skipping the test without the privileges to open it
+func QuerySocket(t *testing.T, network string, address string) *RawSocket {
+	t.Helper()
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		t.Skipf("net.ListenPacket(%s, %s): %v", network, address, err)
+	}
+	s := &RawSocket{Name: "IGMP", Conn: conn}
+	if network == "ip6:58" {
+		s.Conn6 = ipv6.NewPacketConn(conn)
+	} else {
+		s.Conn4 = ipv4.NewPacketConn(conn)
+	}
+	s.SetRouterAlert()
+	return s
+}
+
+func TestQueryRouterAlert4(t *testing.T) {
+	defer func(transport string) { Transport = transport }(Transport)
+	Transport = "udp4"
+	s := QuerySocket(t, "ip4:2", "127.0.0.1")
+	defer s.Conn.Close()
+	conn, err := net.ListenPacket("ip4:2", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r, err := ipv4.NewRawConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Conn.WriteTo(MakeQuery(nil), &net.IPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.SetReadDeadline(time.Now().Add(time.Second))
+	h, p, _, err := r.ReadFrom(make([]byte, 1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Options, RouterAlert4) || len(p) == 0 || p[0] != IgmpQuery {
+		t.Errorf("query has options %x and type %x, want %x and %x", h.Options, p[0], RouterAlert4, IgmpQuery)
+	}
+}
+
+func TestQueryRouterAlert6(t *testing.T) {
+	defer func(transport string) { Transport = transport }(Transport)
+	Transport = "udp6"
+	s := QuerySocket(t, "ip6:58", "::1")
+	defer s.Conn.Close()
+	conn, err := net.ListenIP("ip6:58", &net.IPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rawConn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPOPTS, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Conn.WriteTo(MakeQuery(nil), &net.IPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, oob := make([]byte, 1500), make([]byte, 1500)
+	for {
+		n, oobn, _, _, err := conn.ReadMsgIP(b, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 || b[0] != MldQuery {
+			continue
+		}
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range messages {
+			// The next header, which the kernel fills in, is not compared
+			if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_HOPOPTS && len(m.Data) == len(RouterAlert6) && bytes.Equal(m.Data[1:], RouterAlert6[1:]) {
+				return
+			}
+		}
+		t.Fatalf("query has control messages %+v, want Hop-by-Hop Options %x", messages, RouterAlert6)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"strconv"
+)
+
+var (
+	RawSockets = make(map[string]*RawSocket)
+)
+
+// RawSocket receives every packet of one IP protocol, such as PIM, and joins the groups that protocol is sent to
+type RawSocket struct {
+	Name   string
+	Groups []net.IP
+	Conn   net.PacketConn
+	Conn4  *ipv4.PacketConn
+	Conn6  *ipv6.PacketConn
+	Joined map[int]net.Interface
+
+	// Guarded by Mutex, Closed is set when the socket is deleted on purpose
+	Err    error
+	Closed bool
+}
+
+// MakeRawSocket listens for a protocol in the family of Transport and passes each packet to handle. Raw sockets need privileges, so errors are only logged when they change.
+func MakeRawSocket(name string, protocol int, groups []net.IP, handle func(CapturedPacket)) {
+	if RawSockets[name] != nil {
+		return
+	}
+
+	network, address := "ip4:"+strconv.Itoa(protocol), "0.0.0.0"
+	if Transport == "udp6" {
+		network, address = "ip6:"+strconv.Itoa(protocol), "::"
+	}
+	conn, err := net.ListenPacket(network, address)
+	key := name + " raw socket"
+	if err != nil {
+		msg := fmt.Sprintf("%s: net.ListenPacket(%s, %s): %v", name, network, address, err)
+		if LogCandidates[key] != msg {
+			LogCandidates[key] = msg
+			Event(LevelWarn, Attrs{"event": "raw_error", "socket": name, "error": err}, "%s", msg)
+		}
+		return
+	}
+	delete(LogCandidates, key)
+	Event(LevelInfo, Attrs{"event": "raw_create", "socket": name, "network": network}, "Making %s socket for %s", name, network)
+
+	s := &RawSocket{
+		Name:   name,
+		Groups: groups,
+		Conn:   conn,
+		Joined: make(map[int]net.Interface),
+	}
+	switch Transport {
+	case "udp4":
+		s.Conn4 = ipv4.NewPacketConn(conn)
+		err = s.Conn4.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst|ipv4.FlagTTL, true)
+	case "udp6":
+		s.Conn6 = ipv6.NewPacketConn(conn)
+		err = s.Conn6.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst|ipv6.FlagHopLimit, true)
+	}
+	if err != nil {
+		Debug("%s: SetControlMessage: %v", name, err)
+	}
+
+	go func() {
+		b := make([]byte, 70000)
+		for {
+			p, err := s.ReadFrom(b)
+			if err != nil {
+				Mutex.Lock()
+				closed := s.Closed
+				if !closed {
+					s.Err = err
+				}
+				Mutex.Unlock()
+				if !closed {
+					Event(LevelWarn, Attrs{"event": "raw_error", "socket": name, "error": err}, "%s: ReadFrom(b): %v", name, err)
+				}
+				return
+			}
+			if len(p.Payload) > 0 {
+				handle(p)
+			}
+		}
+	}()
+
+	Mutex.Lock()
+	RawSockets[name] = s
+	Mutex.Unlock()
+}
+
+// ReadFrom reads a packet along with the interface it arrived on, its destination, and its TTL, where the platform provides them
+func (s *RawSocket) ReadFrom(b []byte) (p CapturedPacket, err error) {
+	var n int
+	var src net.Addr
+	switch {
+	case s.Conn4 != nil:
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = s.Conn4.ReadFrom(b)
+		if cm != nil {
+			p.Dst, p.TTL, p.Interface = cm.Dst, cm.TTL, InterfaceName(cm.IfIndex)
+		}
+		// Some platforms include the IPv4 header on raw sockets
+		if n >= 20 && b[0]>>4 == 4 && int(b[0]&0x0f)*4 <= n {
+			ihl := int(b[0]&0x0f) * 4
+			p.Dst, p.TTL = net.IP(append([]byte{}, b[16:20]...)), int(b[8])
+			b = b[ihl:]
+			n -= ihl
+		}
+	case s.Conn6 != nil:
+		var cm *ipv6.ControlMessage
+		n, cm, src, err = s.Conn6.ReadFrom(b)
+		if cm != nil {
+			p.Dst, p.TTL, p.Interface = cm.Dst, cm.HopLimit, InterfaceName(cm.IfIndex)
+		}
+	}
+	if a, ok := src.(*net.IPAddr); ok {
+		p.Src = a.IP
+	}
+	p.Time = Now()
+	if n > 0 {
+		p.Payload = append([]byte{}, b[:n]...)
+	}
+	return p, err
+}
+
+// Join joins the groups of the socket on the usable interfaces, and leaves them on interfaces that are no longer usable
+func (s *RawSocket) Join(ifaces []net.Interface) {
+	usable := make(map[int]bool)
+	for _, iface := range ifaces {
+		usable[iface.Index] = true
+		for _, group := range s.Groups {
+			a := net.IPAddr{IP: group}
+			switch {
+			case s.Conn4 != nil:
+				_ = s.Conn4.JoinGroup(&iface, &a)
+			case s.Conn6 != nil:
+				_ = s.Conn6.JoinGroup(&iface, &a)
+			}
+		}
+		if _, ok := s.Joined[iface.Index]; !ok {
+			Debug("%s: joined %v on %s", s.Name, s.Groups, iface.Name)
+		}
+		s.Joined[iface.Index] = iface
+	}
+	for index, iface := range s.Joined {
+		if usable[index] {
+			continue
+		}
+		for _, group := range s.Groups {
+			a := net.IPAddr{IP: group}
+			switch {
+			case s.Conn4 != nil:
+				_ = s.Conn4.LeaveGroup(&iface, &a)
+			case s.Conn6 != nil:
+				_ = s.Conn6.LeaveGroup(&iface, &a)
+			}
+		}
+		Debug("%s: left %v on %s", s.Name, s.Groups, iface.Name)
+		delete(s.Joined, index)
+	}
+}
+
+func (s *RawSocket) Close() {
+	Mutex.Lock()
+	s.Closed = true
+	Mutex.Unlock()
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+}
+
+// CheckRawSockets deletes raw sockets with errors, or all of them when the transport changes, so they are recreated
+func CheckRawSockets(all bool) {
+	for name, s := range RawSockets {
+		Mutex.Lock()
+		err := s.Err
+		Mutex.Unlock()
+		if err != nil || all {
+			Event(LevelInfo, Attrs{"event": "raw_delete", "socket": name, "error": err}, "Deleting %s socket", name)
+			s.Close()
+			Mutex.Lock()
+			delete(RawSockets, name)
+			Mutex.Unlock()
+		}
+	}
+}
+
+// InterfaceName returns the name of the interface with index, or the index itself if it has gone
+func InterfaceName(index int) string {
+	if index == 0 {
+		return "unknown"
+	}
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return strconv.Itoa(index)
+	}
+	return iface.Name
+}
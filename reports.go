@@ -15,39 +15,196 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
 	"strings"
 	"time"
 )
 
+var (
+	// ReportSeq starts at a random value, so the reports of a restarted host do not reuse the Seq of a report already reassembled
+	ReportSeq = RandomSeq()
+	Partials  = make(map[string]*Partial)
+
+	// Probes pad themselves to their exact size, so they are compressed without the padding of ZstdEncoder
+	ProbeEncoder = NewZstdEncoder(0)
+)
+
 type Report struct {
-	Host  string
-	Heard map[string]time.Duration
+	Host   string
+	Heard  map[string]time.Duration
+	Seq    uint32
+	Part   int
+	Total  int
+	Local  []string
+	Beacon bool
+
+	// TTL sweeps stamp the TTL each report was sent with, and report the minimum TTL heard from each IP
+	TTL    int
+	MinTTL map[string]int
+
+	// MTU sweeps send probes padded to the size stamped in them, and report the largest size heard from each IP
+	Probe   int
+	Largest map[string]int
+}
+
+// Partial collects the parts of a multi-part report until all parts arrive or the report is superseded
+type Partial struct {
+	Seq   uint32
+	Total int
+	Parts map[int]bool
+	Heard map[string]time.Time
+	Time  time.Time
+	Done  bool
+}
+
+func RandomSeq() uint32 {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint32(b)
 }
 
 func MakeReport() *Report {
 	r := &Report{
-		Host:  Host,
-		Heard: make(map[string]time.Duration),
+		Host:   Host,
+		Heard:  make(map[string]time.Duration),
+		Beacon: Role == "beacon",
 	}
 	now := time.Now()
 	Mutex.Lock()
 	for ip, t := range HeardIPs {
 		r.Heard[ip] = now.Sub(t)
 	}
+	for _, s := range Senders {
+		r.Local = append(r.Local, s.IP.String())
+	}
+	r.MinTTL = MinTTLs(now)
+	r.Largest = LargestSizes(now)
 	Mutex.Unlock()
 	return r
 }
 
 func SendReport() {
-	b := Encode0(MakeReport())
+	if Role == "collector" {
+		return
+	}
+
+	r := MakeReport()
 	Mutex.Lock()
+	ReportSeq++
+	r.Seq = ReportSeq
+	if TTLSweep > 0 {
+		r.TTL = int((r.Seq-1)%uint32(TTLSweep)) + 1
+	}
+	parts := Encode(r)
 	for _, s := range Senders {
-		s.Send(b)
+		if r.TTL > 0 {
+			s.SetTTL(r.TTL)
+		}
+		for _, b := range parts {
+			s.Send(b)
+		}
+	}
+	if len(MTUSweep) > 0 {
+		SendProbe(r.Seq, MTUSweep[(r.Seq-1)%uint32(len(MTUSweep))])
+	}
+	if Publisher != nil {
+		now := time.Now()
+		for ip, a := range HeardAddrs {
+			if now.Sub(HeardIPs[ip]) > 10*time.Second {
+				continue
+			}
+			for _, b := range parts {
+				Publisher.SendTo(b, a)
+			}
+		}
+	}
+	for _, c := range Collectors {
+		for _, b := range parts {
+			c.Send(b)
+		}
 	}
 	Mutex.Unlock()
 }
 
+// StoreReport records a received report, reassembling multi-part reports before they replace HeardDb
+func StoreReport(r *Report, t time.Time) {
+	for _, ip := range r.Local {
+		HostIPs[ip] = r.Host
+	}
+	Beacons[r.Host] = r.Beacon
+
+	// Commit partial reports whose remaining parts are presumed lost
+	for host, p := range Partials {
+		if !p.Done && t.Sub(p.Time) > time.Second {
+			CommitPartial(host, p)
+		}
+	}
+
+	StoreSweeps(r)
+
+	if r.Total <= 1 {
+		HeardHosts[r.Host] = t
+		HeardDb[r.Host] = r.Heard
+		return
+	}
+
+	// Every sender on a host transmits the same parts, so duplicates are expected
+	p := Partials[r.Host]
+	if p == nil || p.Seq != r.Seq {
+		if p != nil && !p.Done {
+			CommitPartial(r.Host, p)
+		}
+		p = &Partial{
+			Seq:   r.Seq,
+			Total: r.Total,
+			Parts: make(map[int]bool),
+			Heard: make(map[string]time.Time),
+		}
+		Partials[r.Host] = p
+	}
+	if p.Done {
+		return
+	}
+	p.Parts[r.Part] = true
+	p.Time = t
+	for ip, d := range r.Heard {
+		p.Heard[ip] = t.Add(-d)
+	}
+
+	if len(p.Parts) >= p.Total {
+		heard := make(map[string]time.Duration)
+		for ip, at := range p.Heard {
+			heard[ip] = t.Sub(at)
+		}
+		HeardHosts[r.Host] = t
+		HeardDb[r.Host] = heard
+		p.Done = true
+	}
+}
+
+// CommitPartial stores an incomplete report, keeping the previous entries for IPs that were in the missing parts
+func CommitPartial(host string, p *Partial) {
+	Debug("Report %d from %s is missing %d of %d parts", p.Seq, host, p.Total-len(p.Parts), p.Total)
+	heard := make(map[string]time.Duration)
+	for ip, d := range HeardDb[host] {
+		heard[ip] = d + p.Time.Sub(HeardHosts[host])
+	}
+	for ip, at := range p.Heard {
+		heard[ip] = p.Time.Sub(at)
+	}
+	HeardHosts[host] = p.Time
+	HeardDb[host] = heard
+	p.Done = true
+}
+
 func Encode0(r *Report) []byte {
 	z := make([]byte, 0, 70000)
 	z = append(z, []byte("macy")...)
@@ -65,6 +222,209 @@ func Encode0(r *Report) []byte {
 	return z
 }
 
+func Encode(r *Report) [][]byte {
+	switch Protocol {
+	case 0:
+		return [][]byte{Encode0(r)}
+	case 1:
+		return Split(r, Encode1)
+	default:
+		return Split(r, Encode2)
+	}
+}
+
+// Split divides a report into as few parts as possible that each fit within MaxSize
+func Split(r *Report, encode func(*Report, []string, int, int) []byte) (z [][]byte) {
+	var ips []string
+	for ip := range r.Heard {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	limit := MaxSize
+	if Padding > limit {
+		limit = Padding
+	}
+
+	// Encode once, then estimate the parts needed from the largest part, since encoding every count in turn is quadratic
+	total := 1
+	for {
+		z = z[:0]
+		largest := 0
+		for part := 0; part < total; part++ {
+			b := encode(r, ips[part*len(ips)/total:(part+1)*len(ips)/total], part, total)
+			if len(b) > largest {
+				largest = len(b)
+			}
+			z = append(z, b)
+		}
+		if largest <= limit || total >= len(ips) || total >= 65535 {
+			if largest > limit {
+				Debug("Split: report does not fit in %d bytes even when split into %d parts", limit, total)
+			}
+			return z
+		}
+		next := total*largest/limit + 1
+		if next > len(ips) {
+			next = len(ips)
+		}
+		if next > 65535 {
+			next = 65535
+		}
+		total = next
+	}
+}
+
+func Encode1(r *Report, ips []string, part int, total int) []byte {
+	z := make([]byte, 0, 70000)
+	z = append(z, []byte("Macy")...)
+
+	c := append([]byte{uint8(len(r.Host))}, []byte(r.Host)...)
+	c = binary.BigEndian.AppendUint32(c, r.Seq)
+	c = binary.BigEndian.AppendUint16(c, uint16(part))
+	c = binary.BigEndian.AppendUint16(c, uint16(total))
+	i := make([]byte, 8)
+	for _, heard := range ips {
+		c = append(c, uint8(len(heard)))
+		c = append(c, []byte(heard)...)
+		binary.BigEndian.PutUint64(i, uint64(r.Heard[heard]))
+		c = append(c, i...)
+	}
+	z = ZstdEncoder.EncodeAll(c, z)
+
+	return z
+}
+
+// Encode2 writes protocol version 2. The dissector in wireshark/macy.lua follows this encoding and must be changed with it.
+func Encode2(r *Report, ips []string, part int, total int) []byte {
+	z := make([]byte, 0, 70000)
+	z = append(z, []byte("mAcy")...)
+
+	c := append([]byte{uint8(len(r.Host))}, []byte(r.Host)...)
+	c = binary.AppendUvarint(c, uint64(r.Seq))
+	c = binary.AppendUvarint(c, uint64(part))
+	c = binary.AppendUvarint(c, uint64(total))
+	var flags uint8
+	if Delta {
+		flags |= 1
+	}
+	if len(r.Local) > 0 {
+		flags |= 2
+	}
+	if r.Beacon {
+		flags |= 4
+	}
+	minTTL := make(map[string]int)
+	for _, heard := range ips {
+		if ttl, ok := r.MinTTL[heard]; ok && net.ParseIP(heard) != nil {
+			minTTL[heard] = ttl
+		}
+	}
+	largest := make(map[string]int)
+	for _, heard := range ips {
+		if size, ok := r.Largest[heard]; ok && net.ParseIP(heard) != nil {
+			largest[heard] = size
+		}
+	}
+	if r.TTL > 0 {
+		flags |= 8
+	}
+	if len(minTTL) > 0 {
+		flags |= 16
+	}
+	if r.Probe > 0 {
+		flags |= 32
+	}
+	if len(largest) > 0 {
+		flags |= 64
+	}
+	c = append(c, flags)
+	if r.TTL > 0 {
+		c = binary.AppendUvarint(c, uint64(r.TTL))
+	}
+	if r.Probe > 0 {
+		c = binary.AppendUvarint(c, uint64(r.Probe))
+	}
+
+	// Addresses that belong to the sending host
+	if len(r.Local) > 0 {
+		c = binary.AppendUvarint(c, uint64(len(r.Local)))
+		for _, local := range r.Local {
+			ip := net.ParseIP(local)
+			switch {
+			case ip == nil:
+				c = append(c, 0, uint8(len(local)))
+				c = append(c, []byte(local)...)
+			case ip.To4() != nil:
+				c = append(c, 4)
+				c = append(c, ip.To4()...)
+			default:
+				c = append(c, 6)
+				c = append(c, ip.To16()...)
+			}
+		}
+	}
+
+	// Minimum TTLs heard from the addresses in this part
+	if len(minTTL) > 0 {
+		c = AppendAddrValues(c, minTTL)
+	}
+
+	// Largest probes heard from the addresses in this part
+	if len(largest) > 0 {
+		c = AppendAddrValues(c, largest)
+	}
+
+	// Sort by address bytes so neighboring addresses share the longest prefixes
+	type record struct {
+		text string
+		ip   net.IP
+	}
+	records := make([]record, 0, len(ips))
+	for _, heard := range ips {
+		records = append(records, record{heard, net.ParseIP(heard)})
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return bytes.Compare(records[i].ip.To16(), records[j].ip.To16()) < 0
+	})
+
+	var prev4, prev6 []byte
+	for _, rec := range records {
+		var addr, prev []byte
+		switch {
+		case rec.ip == nil:
+			c = append(c, 0, uint8(len(rec.text)))
+			c = append(c, []byte(rec.text)...)
+		case rec.ip.To4() != nil:
+			addr = rec.ip.To4()
+			prev, prev4 = prev4, addr
+			c = append(c, 4)
+		default:
+			addr = rec.ip.To16()
+			prev, prev6 = prev6, addr
+			c = append(c, 6)
+		}
+		if addr != nil {
+			if Delta {
+				n := 0
+				for n < len(prev) && n < len(addr)-1 && prev[n] == addr[n] {
+					n++
+				}
+				c = append(c, uint8(n))
+				addr = addr[n:]
+			}
+			c = append(c, addr...)
+		}
+		c = binary.AppendUvarint(c, uint64(r.Heard[rec.text].Milliseconds()))
+	}
+	if r.Probe > 0 {
+		return ProbeEncoder.EncodeAll(c, z)
+	}
+	z = ZstdEncoder.EncodeAll(c, z)
+
+	return z
+}
+
 func Decode(b []byte) (z *Report) {
 	// Check header
 	if len(b) < 4 || strings.ToUpper(string(b[0:4])) != "MACY" {
@@ -87,6 +447,10 @@ func Decode(b []byte) (z *Report) {
 	switch version {
 	case 0:
 		z = Decode0(b[4:])
+	case 1:
+		z = Decode1(b[4:])
+	case 2:
+		z = Decode2(b[4:])
 	default:
 		Debug("Decode: protocol version %d not supported", version)
 		return nil
@@ -95,25 +459,71 @@ func Decode(b []byte) (z *Report) {
 }
 
 func Decode0(b []byte) *Report {
-	// Decompress
-	if len(b) < 4 {
-		Debug("Decode: buffer is too short to identify compression type")
+	b = Decompress(b)
+	if b == nil {
 		return nil
 	}
-	switch {
-	case b[3] == 0xfd && b[2] == 0x2f && b[1] == 0xb5 && b[0] == 0x28:
-		c, err := ZstdDecoder.DecodeAll(b, nil)
-		if err != nil {
-			Debug("Decode: zstd.DecodeAll: %v", err)
-			return nil
-		}
-		b = c
-	default:
-		Debug("Decode: unrecognized compression magic %x", b[0:4])
+
+	// Parse hostname
+	if len(b) < 1 {
+		Debug("Decode: buffer is too short to decode host")
+		return nil
+	}
+	l := int(uint8(b[0]))
+	if len(b) < 1+l {
+		Debug("Decode: buffer is too short to decode host")
 		return nil
 	}
+	z := &Report{
+		Host:  string(b[1 : 1+l]),
+		Heard: make(map[string]time.Duration),
+	}
+	b = b[1+l:]
 
-	// Parse hostname
+	DecodeHeard(b, z)
+	return z
+}
+
+func Decode1(b []byte) *Report {
+	b = Decompress(b)
+	if b == nil {
+		return nil
+	}
+
+	// Parse hostname and part numbers
+	if len(b) < 1 {
+		Debug("Decode: buffer is too short to decode host")
+		return nil
+	}
+	l := int(uint8(b[0]))
+	if len(b) < 1+l+8 {
+		Debug("Decode: buffer is too short to decode host and part numbers")
+		return nil
+	}
+	z := &Report{
+		Host:  string(b[1 : 1+l]),
+		Heard: make(map[string]time.Duration),
+		Seq:   binary.BigEndian.Uint32(b[1+l : 1+l+4]),
+		Part:  int(binary.BigEndian.Uint16(b[1+l+4 : 1+l+6])),
+		Total: int(binary.BigEndian.Uint16(b[1+l+6 : 1+l+8])),
+	}
+	b = b[1+l+8:]
+	if z.Part >= z.Total {
+		Debug("Decode: part %d of %d from %s is out of range", z.Part, z.Total, z.Host)
+		return nil
+	}
+
+	DecodeHeard(b, z)
+	return z
+}
+
+func Decode2(b []byte) *Report {
+	b = Decompress(b)
+	if b == nil {
+		return nil
+	}
+
+	// Parse hostname, part numbers, and flags
 	if len(b) < 1 {
 		Debug("Decode: buffer is too short to decode host")
 		return nil
@@ -128,10 +538,269 @@ func Decode0(b []byte) *Report {
 		Heard: make(map[string]time.Duration),
 	}
 	b = b[1+l:]
+	var v [3]uint64
+	for i := range v {
+		var n int
+		v[i], n = binary.Uvarint(b)
+		if n <= 0 {
+			Debug("Decode: buffer is too short to decode part numbers")
+			return nil
+		}
+		b = b[n:]
+	}
+	z.Seq, z.Part, z.Total = uint32(v[0]), int(v[1]), int(v[2])
+	if z.Part >= z.Total {
+		Debug("Decode: part %d of %d from %s is out of range", z.Part, z.Total, z.Host)
+		return nil
+	}
+	if len(b) < 1 {
+		Debug("Decode: buffer is too short to decode flags")
+		return nil
+	}
+	delta := b[0]&1 != 0
+	local := b[0]&2 != 0
+	z.Beacon = b[0]&4 != 0
+	stamped := b[0]&8 != 0
+	minTTL := b[0]&16 != 0
+	probe := b[0]&32 != 0
+	largest := b[0]&64 != 0
+	b = b[1:]
+	if stamped {
+		ttl, n := binary.Uvarint(b)
+		if n <= 0 {
+			Debug("Decode: buffer is too short to decode TTL")
+			return nil
+		}
+		z.TTL = int(ttl)
+		b = b[n:]
+	}
+	if probe {
+		size, n := binary.Uvarint(b)
+		if n <= 0 {
+			Debug("Decode: buffer is too short to decode probe size")
+			return nil
+		}
+		z.Probe = int(size)
+		b = b[n:]
+	}
+
+	// Parse addresses that belong to the sending host
+	if local {
+		count, n := binary.Uvarint(b)
+		if n <= 0 {
+			Debug("Decode: buffer is too short to decode local addresses")
+			return nil
+		}
+		b = b[n:]
+		for i := uint64(0); i < count; i++ {
+			if len(b) < 1 {
+				Debug("Decode: truncated local address")
+				return nil
+			}
+			switch {
+			case b[0] == 0 && len(b) >= 2 && len(b) >= 2+int(b[1]):
+				z.Local = append(z.Local, string(b[2:2+int(b[1])]))
+				b = b[2+int(b[1]):]
+			case b[0] == 4 && len(b) >= 1+net.IPv4len:
+				z.Local = append(z.Local, net.IP(b[1:1+net.IPv4len]).String())
+				b = b[1+net.IPv4len:]
+			case b[0] == 6 && len(b) >= 1+net.IPv6len:
+				z.Local = append(z.Local, net.IP(b[1:1+net.IPv6len]).String())
+				b = b[1+net.IPv6len:]
+			default:
+				Debug("Decode: invalid local address")
+				return nil
+			}
+		}
+	}
+
+	// Parse minimum TTLs
+	if minTTL {
+		var ok bool
+		z.MinTTL, b, ok = DecodeAddrValues(b)
+		if !ok {
+			Debug("Decode: invalid minimum TTLs")
+			return nil
+		}
+	}
+	if largest {
+		var ok bool
+		z.Largest, b, ok = DecodeAddrValues(b)
+		if !ok {
+			Debug("Decode: invalid largest sizes")
+			return nil
+		}
+	}
 
 	// Parse heard records
+	var prev4, prev6 []byte
 	for len(b) > 0 {
-		l = int(uint8(b[0]))
+		var heard string
+		var size int
+		var prev *[]byte
+		switch b[0] {
+		case 0:
+			if len(b) < 2 || len(b) < 2+int(b[1]) {
+				Debug("Decode: truncated address record")
+				return z
+			}
+			heard = string(b[2 : 2+int(b[1])])
+			b = b[2+int(b[1]):]
+		case 4:
+			size, prev = net.IPv4len, &prev4
+			b = b[1:]
+		case 6:
+			size, prev = net.IPv6len, &prev6
+			b = b[1:]
+		default:
+			Debug("Decode: unrecognized address family %d", b[0])
+			return z
+		}
+		if prev != nil {
+			addr := make([]byte, 0, size)
+			if delta {
+				if len(b) < 1 || int(b[0]) > len(*prev) || int(b[0]) >= size {
+					Debug("Decode: invalid address prefix length")
+					return z
+				}
+				addr = append(addr, (*prev)[:b[0]]...)
+				b = b[1:]
+			}
+			if len(b) < size-len(addr) {
+				Debug("Decode: truncated address record")
+				return z
+			}
+			n := size - len(addr)
+			addr = append(addr, b[:n]...)
+			b = b[n:]
+			*prev = addr
+			heard = net.IP(addr).String()
+		}
+		ms, n := binary.Uvarint(b)
+		if n <= 0 {
+			Debug("Decode: truncated duration for %s", heard)
+			return z
+		}
+		b = b[n:]
+		z.Heard[heard] = time.Duration(ms) * time.Millisecond
+	}
+
+	return z
+}
+
+// MakeProbe encodes a report without heard IPs, padded with a skippable zstd frame to exactly size bytes, or returns nil if it does not fit
+func MakeProbe(seq uint32, size int) []byte {
+	r := &Report{Host: Host, Seq: seq, Total: 1, Beacon: Role == "beacon", Probe: size}
+	b := Encode2(r, nil, 0, 1)
+	pad := size - len(b) - 8
+	if pad < 0 {
+		return nil
+	}
+	b = binary.LittleEndian.AppendUint32(b, 0x184d2a50)
+	b = binary.LittleEndian.AppendUint32(b, uint32(pad))
+	return append(b, make([]byte, pad)...)
+}
+
+// SendProbe sends a probe of size on every sender. Mutex must be held.
+func SendProbe(seq uint32, size int) {
+	b := MakeProbe(seq, size)
+	if b == nil {
+		Debug("MTU sweep: a probe does not fit in %d bytes", size)
+		return
+	}
+	for key, s := range Senders {
+		err := s.WriteGroup(b)
+		if err == nil {
+			continue
+		}
+		// Sizes above the interface MTU are expected to fail with DF set
+		msg := fmt.Sprintf("MTU sweep: %s: %v", key, err)
+		if s.ProbeErr != msg {
+			s.ProbeErr = msg
+			Debug(msg)
+		}
+	}
+}
+
+// AppendAddrValues appends a count followed by each address and its value, sorted by address
+func AppendAddrValues(c []byte, values map[string]int) []byte {
+	var ips []string
+	for ip := range values {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return IPLess(ips[i], ips[j]) })
+	c = binary.AppendUvarint(c, uint64(len(ips)))
+	for _, text := range ips {
+		ip := net.ParseIP(text)
+		if ip.To4() != nil {
+			c = append(c, 4)
+			c = append(c, ip.To4()...)
+		} else {
+			c = append(c, 6)
+			c = append(c, ip.To16()...)
+		}
+		c = binary.AppendUvarint(c, uint64(values[text]))
+	}
+	return c
+}
+
+// DecodeAddrValues decodes what AppendAddrValues appends, returning the rest of b
+func DecodeAddrValues(b []byte) (map[string]int, []byte, bool) {
+	z := make(map[string]int)
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, b, false
+	}
+	b = b[n:]
+	for i := uint64(0); i < count; i++ {
+		var size int
+		switch {
+		case len(b) >= 1 && b[0] == 4:
+			size = net.IPv4len
+		case len(b) >= 1 && b[0] == 6:
+			size = net.IPv6len
+		default:
+			return nil, b, false
+		}
+		if len(b) < 1+size {
+			return nil, b, false
+		}
+		ip := net.IP(b[1 : 1+size]).String()
+		b = b[1+size:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, b, false
+		}
+		z[ip] = int(v)
+		b = b[n:]
+	}
+	return z, b, true
+}
+
+func Decompress(b []byte) []byte {
+	if len(b) < 4 {
+		Debug("Decode: buffer is too short to identify compression type")
+		return nil
+	}
+	switch {
+	case b[3] == 0xfd && b[2] == 0x2f && b[1] == 0xb5 && b[0] == 0x28:
+		c, err := ZstdDecoder.DecodeAll(b, nil)
+		if err != nil {
+			Debug("Decode: zstd.DecodeAll: %v", err)
+			return nil
+		}
+		b = c
+	default:
+		Debug("Decode: unrecognized compression magic %x", b[0:4])
+		return nil
+	}
+	return b
+}
+
+func DecodeHeard(b []byte, z *Report) {
+	// Parse heard records
+	for len(b) > 0 {
+		l := int(uint8(b[0]))
 		if l == 0 {
 			b = b[1:]
 			continue
@@ -142,6 +811,4 @@ func Decode0(b []byte) *Report {
 		z.Heard[string(b[1:1+l])] = time.Duration(binary.BigEndian.Uint64(b[1+l : 1+l+8]))
 		b = b[1+l+8:]
 	}
-
-	return z
 }
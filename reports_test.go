@@ -0,0 +1,301 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func init() {
+	ZstdEncoder = NewZstdEncoder(0)
+	ZstdDecoder, _ = zstd.NewReader(nil)
+	MaxSize = 1400
+}
+
+// SampleReport returns a report that sets each protocol 2 flag present in flags
+func SampleReport(flags uint8) *Report {
+	r := &Report{
+		Host: "host1",
+		Heard: map[string]time.Duration{
+			"10.0.0.1":     time.Second,
+			"10.0.0.2":     2500 * time.Millisecond,
+			"10.0.1.1":     0,
+			"2001:db8::1":  40 * time.Millisecond,
+			"2001:db8::2":  time.Minute,
+			"fe80::1%eth0": 3 * time.Millisecond,
+		},
+		Seq:   4000000000,
+		Total: 1,
+	}
+	if flags&2 != 0 {
+		r.Local = []string{"192.0.2.1", "2001:db8::9", "fe80::9%eth0"}
+	}
+	r.Beacon = flags&4 != 0
+	if flags&8 != 0 {
+		r.TTL = 200
+	}
+	if flags&16 != 0 {
+		r.MinTTL = map[string]int{"10.0.0.1": 1, "2001:db8::2": 255}
+	}
+	if flags&32 != 0 {
+		r.Probe = 9000
+	}
+	if flags&64 != 0 {
+		r.Largest = map[string]int{"10.0.0.2": 1500, "2001:db8::1": 65527}
+	}
+	return r
+}
+
+func EncodeSampleReport(t *testing.T, r *Report) []byte {
+	t.Helper()
+	var ips []string
+	for ip := range r.Heard {
+		ips = append(ips, ip)
+	}
+	return Encode2(r, ips, r.Part, r.Total)
+}
+
+func TestDecode2RoundTrip(t *testing.T) {
+	defer func(delta bool) { Delta = delta }(Delta)
+	for flags := 0; flags < 128; flags++ {
+		t.Run(fmt.Sprintf("flags %d", flags), func(t *testing.T) {
+			Delta = flags&1 != 0
+			r := SampleReport(uint8(flags))
+			z := Decode(EncodeSampleReport(t, r))
+			if z == nil {
+				t.Fatal("Decode returned nil")
+			}
+			if !reflect.DeepEqual(z, r) {
+				t.Errorf("Decode = %+v, want %+v", z, r)
+			}
+		})
+	}
+}
+
+func TestDecode2Parts(t *testing.T) {
+	r := SampleReport(0)
+	r.Part, r.Total = 2, 3
+	z := Decode(EncodeSampleReport(t, r))
+	if z == nil || z.Part != 2 || z.Total != 3 {
+		t.Fatalf("Decode = %+v, want part 2 of 3", z)
+	}
+
+	r.Part = 3
+	if z := Decode(EncodeSampleReport(t, r)); z != nil {
+		t.Errorf("Decode of part 3 of 3 = %+v, want nil", z)
+	}
+}
+
+func TestDecode2Truncated(t *testing.T) {
+	defer func(delta bool) { Delta = delta }(Delta)
+	for flags := 0; flags < 128; flags++ {
+		Delta = flags&1 != 0
+		r := SampleReport(uint8(flags))
+		c := Decompress(EncodeSampleReport(t, r)[4:])
+		for n := 0; n < len(c); n++ {
+			b := append([]byte("mAcy"), ZstdEncoder.EncodeAll(c[:n], nil)...)
+			z := Decode(b)
+			if z == nil {
+				continue
+			}
+			// Truncated heard records are dropped, anything before them fails the whole report
+			if z.Host != r.Host || z.TTL != r.TTL || z.Probe != r.Probe || !reflect.DeepEqual(z.Local, r.Local) {
+				t.Fatalf("flags %d: Decode of %d of %d bytes = %+v", flags, n, len(c), z)
+			}
+			for ip, d := range z.Heard {
+				if r.Heard[ip] != d {
+					t.Fatalf("flags %d: Decode of %d of %d bytes heard %s %v, want %v", flags, n, len(c), ip, d, r.Heard[ip])
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeGarbage(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		[]byte("mA"),
+		[]byte("mAcy"),
+		[]byte("mAcy\x28\xb5\x2f\xfd"),
+		[]byte("mAcyjunk"),
+		[]byte("MACY\x28\xb5\x2f\xfd\x00"),
+	} {
+		if z := Decode(b); z != nil {
+			t.Errorf("Decode(%q) = %+v, want nil", b, z)
+		}
+	}
+}
+
+func TestAddrValues(t *testing.T) {
+	values := map[string]int{"10.0.0.1": 0, "10.0.0.2": 300, "2001:db8::1": 1 << 20}
+	b := AppendAddrValues([]byte{}, values)
+	b = append(b, 0xff)
+	z, rest, ok := DecodeAddrValues(b)
+	if !ok || !reflect.DeepEqual(z, values) || len(rest) != 1 {
+		t.Fatalf("DecodeAddrValues = %v, %x, %v", z, rest, ok)
+	}
+	for n := 0; n < len(b)-1; n++ {
+		if _, _, ok := DecodeAddrValues(b[:n]); ok {
+			t.Errorf("DecodeAddrValues of %d of %d bytes succeeded", n, len(b)-1)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	defer func(delta bool) { Delta = delta }(Delta)
+	for _, delta := range []bool{false, true} {
+		Delta = delta
+		r := &Report{Host: "host1", Heard: make(map[string]time.Duration)}
+		for i := 0; i < 2000; i++ {
+			r.Heard[fmt.Sprintf("10.0.%d.%d", i/256, i%256)] = time.Duration(i) * time.Millisecond
+		}
+		parts := Split(r, Encode2)
+		if len(parts) < 2 {
+			t.Fatalf("Split into %d parts, want several", len(parts))
+		}
+		heard := make(map[string]time.Duration)
+		for i, b := range parts {
+			if len(b) > MaxSize {
+				t.Errorf("part %d is %d bytes, more than %d", i, len(b), MaxSize)
+			}
+			z := Decode(b)
+			if z == nil || z.Part != i || z.Total != len(parts) {
+				t.Fatalf("part %d decodes as %+v", i, z)
+			}
+			for ip, d := range z.Heard {
+				heard[ip] = d
+			}
+		}
+		if !reflect.DeepEqual(heard, r.Heard) {
+			t.Errorf("parts hold %d IPs, want %d", len(heard), len(r.Heard))
+		}
+	}
+}
+
+func TestStoreSweeps(t *testing.T) {
+	defer func() {
+		HeardTTLs = make(map[string]map[string]int)
+		HeardSizes = make(map[string]map[string]int)
+		SweepSeqs = make(map[string]uint32)
+	}()
+	StoreSweeps(&Report{Host: "a", Seq: 1, Part: 0, Total: 2, MinTTL: map[string]int{"10.0.0.1": 3}, Largest: map[string]int{"10.0.0.1": 1400}})
+	StoreSweeps(&Report{Host: "a", Seq: 1, Part: 1, Total: 2, MinTTL: map[string]int{"10.0.0.2": 4}})
+	if len(HeardTTLs["a"]) != 2 || HeardSizes["a"]["10.0.0.1"] != 1400 {
+		t.Errorf("after both parts, HeardTTLs = %v, HeardSizes = %v", HeardTTLs["a"], HeardSizes["a"])
+	}
+
+	// 10.0.0.1 aged out of the next report
+	StoreSweeps(&Report{Host: "a", Seq: 2, Part: 0, Total: 2, MinTTL: map[string]int{"10.0.0.2": 5}})
+	if want := map[string]int{"10.0.0.2": 5}; !reflect.DeepEqual(HeardTTLs["a"], want) || len(HeardSizes["a"]) != 0 {
+		t.Errorf("after the next report, HeardTTLs = %v, want %v, HeardSizes = %v", HeardTTLs["a"], want, HeardSizes["a"])
+	}
+}
+
+func TestMakeProbe(t *testing.T) {
+	// Probes smaller than the padding of reports still fit
+	defer func(e *zstd.Encoder) { ZstdEncoder = e }(ZstdEncoder)
+	ZstdEncoder = NewZstdEncoder(1400)
+	Host = "host1"
+	for _, size := range []int{200, 1400, 8972} {
+		b := MakeProbe(7, size)
+		if len(b) != size {
+			t.Errorf("MakeProbe(%d) is %d bytes", size, len(b))
+			continue
+		}
+		if r := Decode(b); r == nil || r.Probe != size || r.Seq != 7 {
+			t.Errorf("Decode of MakeProbe(%d) = %+v", size, r)
+		}
+	}
+	if b := MakeProbe(7, 10); b != nil {
+		t.Errorf("MakeProbe(10) is %d bytes, want nil", len(b))
+	}
+}
+
+func TestStoreReportParts(t *testing.T) {
+	type step struct {
+		host   string
+		seq    uint32
+		part   int
+		total  int
+		ips    []string
+		offset time.Duration
+	}
+	for _, c := range []struct {
+		name  string
+		steps []step
+		want  map[string][]string
+	}{
+		{"lost middle part keeps the IPs of the previous report", []step{
+			{"a", 1, 0, 1, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, 0},
+			{"a", 2, 0, 3, []string{"10.0.0.1"}, time.Second},
+			{"a", 2, 2, 3, []string{"10.0.0.3"}, time.Second},
+			{"b", 1, 0, 1, []string{"10.0.0.9"}, 3 * time.Second},
+		}, map[string][]string{"a": {"10.0.0.1", "10.0.0.2", "10.0.0.3"}, "b": {"10.0.0.9"}}},
+		{"newer Seq supersedes an incomplete set", []step{
+			{"a", 1, 0, 2, []string{"10.0.0.1"}, 0},
+			{"a", 2, 0, 2, []string{"10.0.0.2"}, 0},
+			{"a", 2, 1, 2, []string{"10.0.0.3"}, 0},
+		}, map[string][]string{"a": {"10.0.0.2", "10.0.0.3"}}},
+		{"duplicate parts do not complete a set", []step{
+			{"a", 1, 0, 2, []string{"10.0.0.1"}, 0},
+			{"a", 1, 0, 2, []string{"10.0.0.1"}, 0},
+		}, map[string][]string{}},
+		{"duplicate parts after completion are ignored", []step{
+			{"a", 1, 0, 2, []string{"10.0.0.1"}, 0},
+			{"a", 1, 1, 2, []string{"10.0.0.2"}, 0},
+			{"a", 1, 1, 2, []string{"10.0.0.2"}, 0},
+			{"a", 1, 0, 2, []string{"10.0.0.1"}, 0},
+		}, map[string][]string{"a": {"10.0.0.1", "10.0.0.2"}}},
+		{"interleaved hosts", []step{
+			{"a", 1, 0, 2, []string{"10.0.0.1"}, 0},
+			{"b", 7, 0, 2, []string{"10.0.1.1"}, 0},
+			{"a", 1, 1, 2, []string{"10.0.0.2"}, 0},
+			{"b", 7, 1, 2, []string{"10.0.1.2"}, 0},
+		}, map[string][]string{"a": {"10.0.0.1", "10.0.0.2"}, "b": {"10.0.1.1", "10.0.1.2"}}},
+	} {
+		HeardHosts = make(map[string]time.Time)
+		HeardDb = make(map[string]map[string]time.Duration)
+		Partials = make(map[string]*Partial)
+		t0 := time.Unix(1700000000, 0)
+		for _, s := range c.steps {
+			r := &Report{Host: s.host, Seq: s.seq, Part: s.part, Total: s.total, Heard: make(map[string]time.Duration)}
+			for _, ip := range s.ips {
+				r.Heard[ip] = 100 * time.Millisecond
+			}
+			StoreReport(r, t0.Add(s.offset))
+		}
+		got := make(map[string][]string)
+		for host, heard := range HeardDb {
+			for ip := range heard {
+				got[host] = append(got[host], ip)
+			}
+			sort.Strings(got[host])
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: HeardDb has %v, want %v", c.name, got, c.want)
+		}
+	}
+	HeardHosts = make(map[string]time.Time)
+	HeardDb = make(map[string]map[string]time.Duration)
+	Partials = make(map[string]*Partial)
+	HeardTTLs = make(map[string]map[string]int)
+	HeardSizes = make(map[string]map[string]int)
+	SweepSeqs = make(map[string]uint32)
+}
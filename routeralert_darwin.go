@@ -0,0 +1,33 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func SetRouterAlert4(fd uintptr) {
+	err := unix.SetsockoptString(int(fd), unix.IPPROTO_IP, unix.IP_OPTIONS, string(RouterAlert4))
+	if err != nil {
+		Warn("unix.SetsockoptString(%v, %v, %v, %x): %v", fd, unix.IPPROTO_IP, unix.IP_OPTIONS, RouterAlert4, err)
+	}
+}
+
+func SetRouterAlert6(fd uintptr) {
+	err := unix.SetsockoptString(int(fd), unix.IPPROTO_IPV6, unix.IPV6_HOPOPTS, string(RouterAlert6))
+	if err != nil {
+		Warn("unix.SetsockoptString(%v, %v, %v, %x): %v", fd, unix.IPPROTO_IPV6, unix.IPV6_HOPOPTS, RouterAlert6, err)
+	}
+}
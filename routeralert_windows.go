@@ -0,0 +1,40 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// https://learn.microsoft.com/en-us/windows/win32/winsock/ipproto-ip-socket-options
+	// https://learn.microsoft.com/en-us/windows/win32/winsock/ipproto-ipv6-socket-options
+	IPOPTIONS   = 1
+	IPV6HOPOPTS = 1
+)
+
+func SetRouterAlert4(fd uintptr) {
+	err := windows.Setsockopt(windows.Handle(fd), windows.IPPROTO_IP, IPOPTIONS, &RouterAlert4[0], int32(len(RouterAlert4)))
+	if err != nil {
+		Warn("windows.Setsockopt(%v, %v, %v, %x): %v", fd, windows.IPPROTO_IP, IPOPTIONS, RouterAlert4, err)
+	}
+}
+
+func SetRouterAlert6(fd uintptr) {
+	err := windows.Setsockopt(windows.Handle(fd), windows.IPPROTO_IPV6, IPV6HOPOPTS, &RouterAlert6[0], int32(len(RouterAlert6)))
+	if err != nil {
+		Warn("windows.Setsockopt(%v, %v, %v, %x): %v", fd, windows.IPPROTO_IPV6, IPV6HOPOPTS, RouterAlert6, err)
+	}
+}
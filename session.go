@@ -0,0 +1,407 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session files start with SessionMagic, followed by records of a kind byte, the length of the body as a uvarint, and the body.
+// Every body starts with the time as a varint of unix nanoseconds.
+const (
+	SessionMagic = "macyrec1"
+
+	// A start record holds SessionInfo as JSON, a report record holds the ingress, source, and datagram, and an event record holds a log entry as JSON
+	SessionStart  = 'S'
+	SessionReport = 'R'
+	SessionEvent  = 'E'
+
+	// How a recorded report arrived
+	IngressGroup     = 0
+	IngressUnicast   = 1
+	IngressCollector = 2
+)
+
+var (
+	Recording *Session
+
+	// Replay clock, which runs from the time of the first record at ReplaySpeed and stops at the end of the file
+	ReplayFrom time.Time
+	ReplayAt   time.Time
+	ReplayStop atomic.Int64
+)
+
+// Session is an append-only file of received reports and socket events
+type Session struct {
+	File  *os.File
+	Mutex sync.Mutex
+}
+
+// SessionInfo is the configuration of the recording instance
+type SessionInfo struct {
+	Host  string        `json:"host"`
+	Group string        `json:"group"`
+	Port  int           `json:"port"`
+	TTL   int           `json:"ttl"`
+	QoS   int           `json:"qos"`
+	Rate  int           `json:"rate"`
+	Role  string        `json:"role"`
+	Stale time.Duration `json:"stale"`
+}
+
+// SessionSink passes log entries for socket events to the recording
+type SessionSink struct{}
+
+// Now returns the current time, or the time reached in the recording during replay once the recording is open
+func Now() time.Time {
+	if Replay == "" || ReplayAt.IsZero() {
+		return time.Now()
+	}
+	if stop := ReplayStop.Load(); stop != 0 {
+		return time.Unix(0, stop)
+	}
+	return ReplayFrom.Add(time.Duration(float64(time.Since(ReplayAt)) * ReplaySpeed))
+}
+
+// OpenSession opens a recording for appending, and records the current configuration
+func OpenSession(path string) (*Session, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		_, err = f.WriteString(SessionMagic)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &Session{File: f}
+
+	b, _ := json.Marshal(SessionInfo{Host: Host, Group: Group.String(), Port: Port, TTL: TTL, QoS: QoS, Rate: Rate, Role: Role, Stale: Stale})
+	s.Write(SessionStart, time.Now(), b)
+	return s, nil
+}
+
+// Write appends one record with a single write, so a record is never interleaved with another
+func (s *Session) Write(kind byte, t time.Time, body []byte) {
+	if s == nil {
+		return
+	}
+	b := binary.AppendVarint(nil, t.UnixNano())
+	b = append(b, body...)
+	z := append([]byte{kind}, binary.AppendUvarint(nil, uint64(len(b)))...)
+	z = append(z, b...)
+
+	s.Mutex.Lock()
+	if s.File != nil {
+		_, err := s.File.Write(z)
+		if err != nil {
+			// Writes come from the sink while LogMutex is held, so the error is logged from another goroutine
+			s.File.Close()
+			s.File = nil
+			go Warn("Recording stopped: %v", err)
+		}
+	}
+	s.Mutex.Unlock()
+}
+
+// Report records a datagram that decoded as a report, along with the interface and destination it arrived on where known
+func (s *Session) Report(ingress byte, from net.Addr, ifindex int, dst net.IP, b []byte, t time.Time) {
+	if s == nil {
+		return
+	}
+	var ip net.IP
+	var port int
+	switch a := from.(type) {
+	case *net.UDPAddr:
+		if a != nil {
+			ip, port = a.IP, a.Port
+		}
+	case *net.TCPAddr:
+		if a != nil {
+			ip, port = a.IP, a.Port
+		}
+	}
+	z := []byte{ingress}
+	z = AppendIP(z, ip)
+	z = binary.AppendUvarint(z, uint64(port))
+	z = binary.AppendUvarint(z, uint64(ifindex))
+	z = AppendIP(z, dst)
+	z = append(z, b...)
+	s.Write(SessionReport, t, z)
+}
+
+func (s *Session) Close() {
+	if s == nil {
+		return
+	}
+	s.Mutex.Lock()
+	if s.File != nil {
+		s.File.Close()
+		s.File = nil
+	}
+	s.Mutex.Unlock()
+}
+
+func (s *SessionSink) Write(e LogEntry) {
+	if _, ok := e.Attrs["event"]; ok {
+		Recording.Write(SessionEvent, e.Time, e.JSON())
+	}
+}
+
+func (s *SessionSink) Close() {
+	Recording.Close()
+}
+
+// AppendIP appends a family tag of 4 or 6 followed by the address, or a tag of 0 if there is no address
+func AppendIP(b []byte, ip net.IP) []byte {
+	switch {
+	case ip == nil:
+		return append(b, 0)
+	case ip.To4() != nil:
+		return append(append(b, 4), ip.To4()...)
+	default:
+		return append(append(b, 6), ip.To16()...)
+	}
+}
+
+// ReadIP reads an address written by AppendIP and returns the rest of b
+func ReadIP(b []byte) (net.IP, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	var n int
+	switch b[0] {
+	case 0:
+		return nil, b[1:], nil
+	case 4:
+		n = net.IPv4len
+	case 6:
+		n = net.IPv6len
+	default:
+		return nil, nil, fmt.Errorf("unknown address family %d", b[0])
+	}
+	if len(b) < 1+n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return net.IP(append([]byte{}, b[1:1+n]...)), b[1+n:], nil
+}
+
+// SessionReader reads the records of a recording in order
+type SessionReader struct {
+	r *bufio.Reader
+}
+
+func NewSessionReader(r io.Reader) (*SessionReader, error) {
+	z := &SessionReader{r: bufio.NewReaderSize(r, 1<<20)}
+	magic := make([]byte, len(SessionMagic))
+	_, err := io.ReadFull(z.r, magic)
+	if err != nil || string(magic) != SessionMagic {
+		return nil, fmt.Errorf("not a macy recording")
+	}
+	return z, nil
+}
+
+// Next returns the kind, time, and remaining body of the next record, or io.EOF at the end of the recording
+func (s *SessionReader) Next() (kind byte, t time.Time, body []byte, err error) {
+	kind, err = s.r.ReadByte()
+	if err != nil {
+		return 0, t, nil, err
+	}
+	l, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return 0, t, nil, io.ErrUnexpectedEOF
+	}
+	if l > 1<<20 {
+		return 0, t, nil, fmt.Errorf("record of %d bytes is too large", l)
+	}
+	body = make([]byte, l)
+	_, err = io.ReadFull(s.r, body)
+	if err != nil {
+		return 0, t, nil, io.ErrUnexpectedEOF
+	}
+	nanos, n := binary.Varint(body)
+	if n <= 0 {
+		return 0, t, nil, fmt.Errorf("record has no time")
+	}
+	return kind, time.Unix(0, nanos), body[n:], nil
+}
+
+// OpenReplay reads the configuration at the start of a recording and starts the replay clock
+func OpenReplay(path string) (*SessionReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSessionReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	kind, t, body, err := s.Next()
+	if err != nil || kind != SessionStart {
+		f.Close()
+		return nil, fmt.Errorf("%s: recording does not start with the configuration", path)
+	}
+	err = ApplySessionInfo(body)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	ReplayFrom = t
+	ReplayAt = time.Now()
+	return s, nil
+}
+
+// ApplySessionInfo takes on the configuration of the recording instance, so the views show what it showed
+func ApplySessionInfo(body []byte) error {
+	var info SessionInfo
+	err := json.Unmarshal(body, &info)
+	if err != nil {
+		return err
+	}
+	Mutex.Lock()
+	Host, Group, Port, TTL, QoS, Rate, Role, Stale = info.Host, net.ParseIP(info.Group), info.Port, info.TTL, info.QoS, info.Rate, info.Role, info.Stale
+	Senders = make(map[string]*Socket)
+	Mutex.Unlock()
+	Info("Replaying %s in group %s port %d with TTL %d, QoS %d, rate %d, and role %s", Host, Group, Port, TTL, QoS, Rate, Role)
+	return nil
+}
+
+// PlayReplay feeds the records of a recording to the same state as received reports and socket events, as the replay clock reaches them
+func PlayReplay(s *SessionReader) {
+	var last time.Time
+	for {
+		kind, t, body, err := s.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				Warn("Replay: %v", err)
+			}
+			break
+		}
+		last = t
+		if wait := t.Sub(Now()); wait > 0 {
+			time.Sleep(time.Duration(float64(wait) / ReplaySpeed))
+		}
+
+		switch kind {
+		case SessionStart:
+			err = ApplySessionInfo(body)
+		case SessionReport:
+			err = ReplayReport(body, t)
+		case SessionEvent:
+			err = ReplayEvent(body)
+		default:
+			err = fmt.Errorf("unknown record kind %q", kind)
+		}
+		if err != nil {
+			Warn("Replay: record at %s: %v", t.Format(time.RFC3339), err)
+		}
+	}
+	if last.IsZero() {
+		last = ReplayFrom
+	}
+	ReplayStop.Store(last.UnixNano())
+	Info("Replay finished at %s", last.Format(time.RFC3339))
+}
+
+func ReplayReport(b []byte, t time.Time) error {
+	if len(b) < 1 {
+		return io.ErrUnexpectedEOF
+	}
+	ingress := b[0]
+	ip, b, err := ReadIP(b[1:])
+	if err != nil {
+		return err
+	}
+	var v [2]uint64
+	for i := range v {
+		var n int
+		v[i], n = binary.Uvarint(b)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		b = b[n:]
+	}
+	_, b, err = ReadIP(b)
+	if err != nil {
+		return err
+	}
+	r := Decode(b)
+	if r == nil {
+		return fmt.Errorf("report from %s does not decode", ip)
+	}
+
+	Mutex.Lock()
+	if ingress == IngressGroup {
+		StoreReceived(r, &net.UDPAddr{IP: ip, Port: int(v[0])}, t)
+	} else {
+		StoreReport(r, t)
+	}
+	Mutex.Unlock()
+	return nil
+}
+
+// ReplayEvent logs a recorded event at the levels Event would, and keeps the senders up to date so the local IPs are shown as they were
+func ReplayEvent(b []byte) error {
+	fields := make(map[string]any)
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+	level := LevelInfo
+	for i, name := range LevelNames {
+		if name == fields["level"] {
+			level = i
+		}
+	}
+	msg, _ := fields["msg"].(string)
+	attrs := make(Attrs)
+	for key, value := range fields {
+		switch key {
+		case "time", "level", "host", "msg":
+		default:
+			attrs[key] = value
+		}
+	}
+
+	iface, _ := attrs["interface"].(string)
+	address, _ := attrs["address"].(string)
+	key := fmt.Sprintf("Sender for interface %s address %s", iface, address)
+	Mutex.Lock()
+	switch attrs["event"] {
+	case "sender_create":
+		Senders[key] = &Socket{IP: net.ParseIP(address), Iface: net.Interface{Name: iface}}
+	case "sender_delete":
+		delete(Senders, key)
+	}
+	Mutex.Unlock()
+
+	// Debug events are only shown with -v, as when they were recorded
+	Event(level, attrs, "%s", msg)
+	return nil
+}
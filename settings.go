@@ -0,0 +1,109 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.rocketnine.space/tslocum/cview"
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"strconv"
+)
+
+var (
+	SettingsForm   = cview.NewForm()
+	SettingsStatus = cview.NewTextView()
+)
+
+// MakeSettingsForm fills the Settings view with the running configuration
+func MakeSettingsForm() {
+	// Fields left unedited keep the running value on Apply, so a reload since the form was made is not reverted
+	base := CurrentSettings()
+	ttl := strconv.Itoa(base.TTL)
+	qos := strconv.Itoa(base.QoS)
+	rate := strconv.Itoa(base.Rate)
+	size := strconv.Itoa(base.Size)
+	addresses := base.AddressRegex
+	interfaces := base.InterfaceRegex
+
+	SettingsForm.Clear(true)
+	SettingsForm.AddInputField("TTL", ttl, 6, cview.InputFieldInteger, func(text string) { ttl = text })
+	SettingsForm.AddInputField("QoS", qos, 6, cview.InputFieldInteger, func(text string) { qos = text })
+	SettingsForm.AddInputField("Rate", rate, 6, cview.InputFieldInteger, func(text string) { rate = text })
+	SettingsForm.AddInputField("Size", size, 6, cview.InputFieldInteger, func(text string) { size = text })
+	SettingsForm.AddInputField("Addresses", addresses, 40, nil, func(text string) { addresses = text })
+	SettingsForm.AddInputField("Interfaces", interfaces, 40, nil, func(text string) { interfaces = text })
+	SettingsForm.AddButton("Apply", func() {
+		s := CurrentSettings()
+		for _, f := range []struct {
+			name    string
+			text    string
+			base    int
+			current *int
+		}{{"TTL", ttl, base.TTL, &s.TTL}, {"QoS", qos, base.QoS, &s.QoS}, {"Rate", rate, base.Rate, &s.Rate}, {"Size", size, base.Size, &s.Size}} {
+			value, err := strconv.Atoi(f.text)
+			if err != nil {
+				SettingsStatus.SetText(fmt.Sprintf("[red]%s must be a number", f.name))
+				return
+			}
+			if value != f.base {
+				*f.current = value
+			}
+		}
+		if addresses != base.AddressRegex {
+			s.AddressRegex = addresses
+		}
+		if interfaces != base.InterfaceRegex {
+			s.InterfaceRegex = interfaces
+		}
+		err := s.Validate()
+		if err != nil {
+			SettingsStatus.SetText(fmt.Sprintf("[red]%v", err))
+			return
+		}
+
+		// The socket loop may be busy, such as connecting to collectors, and the UI must not wait for it
+		select {
+		case Reconfigure <- s:
+			base = s
+			SettingsStatus.SetText("[green]Applied, see the Log view for details")
+		default:
+			SettingsStatus.SetText("[yellow]Busy applying earlier settings, try again shortly")
+		}
+	})
+	SettingsForm.AddButton("Reset", func() {
+		MakeSettingsForm()
+		SettingsStatus.SetText("")
+	})
+}
+
+func MakeSettingsView() cview.Primitive {
+	SettingsForm.SetBorder(true)
+	SettingsForm.SetBorderColor(tcell.ColorGrey)
+	SettingsForm.SetTitle(" Tab moves between fields, Apply changes the running configuration ")
+	SettingsForm.SetFieldBackgroundColor(tcell.ColorGrey)
+	SettingsForm.SetFieldBackgroundColorFocused(tcell.ColorDarkCyan)
+	SettingsForm.SetButtonBackgroundColor(tcell.ColorGrey)
+	SettingsForm.SetButtonBackgroundColorFocused(tcell.ColorDarkCyan)
+	MakeSettingsForm()
+
+	SettingsStatus.SetDynamicColors(true)
+	SettingsStatus.SetPadding(0, 0, 1, 1)
+
+	settings := cview.NewFlex()
+	settings.SetDirection(cview.FlexRow)
+	settings.AddItem(SettingsForm, 0, 1, true)
+	settings.AddItem(SettingsStatus, 1, 0, false)
+	return settings
+}
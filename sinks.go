@@ -0,0 +1,258 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	Sinks []Sink
+)
+
+// Sink receives every log entry in addition to the Log view. Writes are serialized by LogMutex.
+type Sink interface {
+	Write(e LogEntry)
+	Close()
+}
+
+// MakeSinks opens the configured sinks and replays the entries logged before they were opened
+func MakeSinks() {
+	var sinks []Sink
+	if LogFile != "" {
+		f := &FileSink{Path: LogFile, Limit: int64(LogFileSize) * 1024 * 1024, Keep: LogFileKeep}
+		err := f.Open()
+		if err != nil {
+			Fatal("Log file %s: %v", LogFile, err)
+		}
+		sinks = append(sinks, f)
+	}
+	if LogStderr {
+		sinks = append(sinks, &StderrSink{Terminal: IsTerminal(os.Stderr)})
+	}
+	if Recording != nil {
+		sinks = append(sinks, &SessionSink{})
+	}
+	if SyslogSocket != "" {
+		s := &SyslogSink{Path: SyslogSocket}
+		err := s.Open()
+		if err != nil {
+			Fatal("Syslog %s: %v", SyslogSocket, err)
+		}
+		sinks = append(sinks, s)
+	}
+
+	LogMutex.Lock()
+	for _, sink := range sinks {
+		for _, e := range LogTail(LogLimit) {
+			sink.Write(e)
+		}
+	}
+	Sinks = append(Sinks, sinks...)
+	LogMutex.Unlock()
+}
+
+// AttrKeys returns the keys of attrs in a stable order
+func AttrKeys(attrs Attrs) (keys []string) {
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Text formats an entry as plain text with its fields as key=value pairs
+func (e LogEntry) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", e.Time.Format("2006-01-02T15:04:05.000Z07:00"), LevelNames[e.Level], e.Message)
+	for _, key := range AttrKeys(e.Attrs) {
+		fmt.Fprintf(&b, " %s=%q", key, fmt.Sprint(e.Attrs[key]))
+	}
+	return b.String()
+}
+
+// JSON formats an entry as a single line of JSON
+func (e LogEntry) JSON() []byte {
+	var b bytes.Buffer
+	field := func(key string, value any) {
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		k, _ := json.Marshal(key)
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('{')
+	field("time", e.Time)
+	field("level", LevelNames[e.Level])
+	field("host", Host)
+	field("msg", e.Message)
+	for _, key := range AttrKeys(e.Attrs) {
+		if err, ok := e.Attrs[key].(error); ok {
+			field(key, err.Error())
+		} else {
+			field(key, e.Attrs[key])
+		}
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// FileSink writes JSON lines to a file, rotating it once it reaches Limit bytes and keeping Keep old files
+type FileSink struct {
+	Path  string
+	Limit int64
+	Keep  int
+	File  *os.File
+	Size  int64
+}
+
+func (f *FileSink) Open() error {
+	var err error
+	f.File, err = os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	f.Size = info.Size()
+	return nil
+}
+
+func (f *FileSink) Rotate() error {
+	err := f.File.Close()
+	if err != nil {
+		return err
+	}
+	for i := f.Keep - 1; i >= 1; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if f.Keep > 0 {
+		err = os.Rename(f.Path, f.Path+".1")
+	} else {
+		err = os.Remove(f.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Open()
+}
+
+func (f *FileSink) Write(e LogEntry) {
+	if f.File == nil {
+		return
+	}
+	b := e.JSON()
+	if f.Limit > 0 && f.Size > 0 && f.Size+int64(len(b)) > f.Limit {
+		err := f.Rotate()
+		if err != nil {
+			// Logging this would recurse into the sink, so report it on the terminal and stop writing
+			fmt.Fprintf(os.Stderr, "macy: rotating %s: %v\n", f.Path, err)
+			f.File = nil
+			return
+		}
+	}
+	n, err := f.File.Write(b)
+	f.Size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "macy: writing %s: %v\n", f.Path, err)
+		f.File = nil
+	}
+}
+
+func (f *FileSink) Close() {
+	if f.File != nil {
+		f.File.Close()
+	}
+}
+
+// StderrSink writes plain text. While the TUI is running it only writes if stderr is redirected away from the terminal, such as with 2>file.
+type StderrSink struct {
+	Terminal bool
+}
+
+func (s *StderrSink) Write(e LogEntry) {
+	if s.Terminal && ViewRunning {
+		return
+	}
+	fmt.Fprintln(os.Stderr, e.Text())
+}
+
+// IsTerminal reports whether f is a terminal rather than a file or pipe
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (s *StderrSink) Close() {}
+
+// SyslogSink sends RFC 3164 messages to the local syslog daemon over a unix datagram socket
+type SyslogSink struct {
+	Path string
+	Conn net.Conn
+}
+
+func (s *SyslogSink) Open() error {
+	var err error
+	s.Conn, err = net.Dial("unixgram", s.Path)
+	return err
+}
+
+func (s *SyslogSink) Write(e LogEntry) {
+	if s.Conn == nil {
+		return
+	}
+
+	// Facility user, with the severity matching the level
+	severity := map[int]int{LevelDebug: 7, LevelInfo: 6, LevelWarn: 4, LevelFatal: 2}[e.Level]
+	text := e.Text()
+	text = text[strings.Index(text, " ")+1:]
+	msg := fmt.Sprintf("<%d>%s macy[%d]: %s", 1*8+severity, e.Time.Format("Jan _2 15:04:05"), os.Getpid(), text)
+	_, err := s.Conn.Write([]byte(msg))
+	if err != nil {
+		// The syslog daemon may have restarted, so reconnect once before giving up
+		s.Conn.Close()
+		err = s.Open()
+		if err == nil {
+			_, err = s.Conn.Write([]byte(msg))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "macy: writing to syslog %s: %v\n", s.Path, err)
+		s.Conn = nil
+	}
+}
+
+func (s *SyslogSink) Close() {
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+}
@@ -26,21 +26,46 @@ import (
 )
 
 var (
-	Receiver *Socket
-	Senders  = make(map[string]*Socket)
+	Receiver  *Socket
+	Senders   = make(map[string]*Socket)
+	Publisher *Socket
+
+	// Errors of each sender by key, kept when the sender is recreated, guarded by Mutex
+	SenderErrors = make(map[string]int)
 )
 
 type Socket struct {
-	Iface net.Interface
-	IP    net.IP
-	Conn  *net.UDPConn
-	Conn4 *ipv4.PacketConn
-	Conn6 *ipv6.PacketConn
-	Err   error
-	Send  func([]byte)
+	Iface  net.Interface
+	IP     net.IP
+	Conn   *net.UDPConn
+	Conn4  *ipv4.PacketConn
+	Conn6  *ipv6.PacketConn
+	Err    error
+	Send   func([]byte)
+	SendTo func([]byte, *net.UDPAddr)
+
+	// TTL the sender currently uses, which changes during TTL sweeps
+	TTL int
+
+	// Largest datagram a report can take including IP and UDP headers, and whether that exceeds the interface MTU
+	WireSize int
+	TooBig   bool
+
+	// Last error sending an MTU sweep probe and the probe sizes above the MTU, so each is logged once
+	ProbeErr string
+	ProbeMTU string
+
+	// Interfaces the Receiver has joined the group on, by index
+	Joined map[int]net.Interface
+
+	// Guarded by Mutex, Closed is set when the socket is deleted on purpose
+	Closed bool
 }
 
 func (s *Socket) Close() {
+	Mutex.Lock()
+	s.Closed = true
+	Mutex.Unlock()
 	var err error
 	if s.Conn4 != nil {
 		err = s.Conn4.Close()
@@ -62,43 +87,251 @@ func (s *Socket) Close() {
 	}
 }
 
+func (s *Socket) LeaveGroup(iface net.Interface, group net.IP) error {
+	a := net.UDPAddr{IP: group}
+	if s.Conn4 != nil {
+		return s.Conn4.LeaveGroup(&iface, &a)
+	}
+	if s.Conn6 != nil {
+		return s.Conn6.LeaveGroup(&iface, &a)
+	}
+	return nil
+}
+
+// Arrival is how a datagram arrived, where the platform provides it
+type Arrival struct {
+	IfIndex int
+	Dst     net.IP
+	TTL     int
+}
+
+// ReadFrom reads a datagram along with the interface it arrived on, its destination address, and its TTL
+func (s *Socket) ReadFrom(b []byte) (n int, from *net.UDPAddr, arrival Arrival, err error) {
+	var src net.Addr
+	switch {
+	case s.Conn4 != nil:
+		var cm *ipv4.ControlMessage
+		n, cm, src, err = s.Conn4.ReadFrom(b)
+		if cm != nil {
+			arrival = Arrival{IfIndex: cm.IfIndex, Dst: cm.Dst, TTL: cm.TTL}
+		}
+	case s.Conn6 != nil:
+		var cm *ipv6.ControlMessage
+		n, cm, src, err = s.Conn6.ReadFrom(b)
+		if cm != nil {
+			arrival = Arrival{IfIndex: cm.IfIndex, Dst: cm.Dst, TTL: cm.HopLimit}
+		}
+	default:
+		n, from, err = s.Conn.ReadFromUDP(b)
+		return n, from, arrival, err
+	}
+	from, _ = src.(*net.UDPAddr)
+	return n, from, arrival, err
+}
+
+// WriteGroup sends a datagram from a sender to the group
+func (s *Socket) WriteGroup(b []byte) error {
+	a := net.UDPAddr{IP: Group, Port: Port}
+	var err error
+	switch {
+	case s.Conn4 != nil:
+		_, err = s.Conn4.WriteTo(b, nil, &a)
+	case s.Conn6 != nil:
+		_, err = s.Conn6.WriteTo(b, nil, &a)
+	}
+	if err == nil {
+		Capture.Write(s.Conn.LocalAddr().(*net.UDPAddr), &a, s.TTL, QoS, !Fragments, PcapOutbound, b, time.Now())
+	}
+	return err
+}
+
+// SetTTL changes the TTL of multicast sent by a sender
+func (s *Socket) SetTTL(ttl int) {
+	if ttl == s.TTL {
+		return
+	}
+	var err error
+	switch {
+	case s.Conn4 != nil:
+		err = s.Conn4.SetMulticastTTL(ttl)
+	case s.Conn6 != nil:
+		err = s.Conn6.SetMulticastHopLimit(ttl)
+	}
+	if err != nil {
+		Warn("%s: SetTTL(%d): %v", SenderKey(s.Iface, s.IP), ttl, err)
+		return
+	}
+	s.TTL = ttl
+}
+
+// StoreReceived records a report received on the group. Mutex must be held.
+func StoreReceived(r *Report, from *net.UDPAddr, t time.Time) {
+	// Probes only count toward the largest size heard
+	if r.Probe > 0 {
+		RecordSize(from.IP.String(), r.Probe, t)
+		return
+	}
+	HeardIPs[from.IP.String()] = t
+	HeardAddrs[from.IP.String()] = from
+	HostIPs[from.IP.String()] = r.Host
+	RecordArrival(from.IP.String(), r, t)
+	if r.TTL > 0 {
+		RecordTTL(from.IP.String(), r.TTL, t)
+	}
+	StoreReport(r, t)
+}
+
 func CheckSockets() {
+	Mutex.Lock()
+	var receiverErr, publisherErr error
+	if Receiver != nil {
+		receiverErr = Receiver.Err
+	}
+	if Publisher != nil {
+		publisherErr = Publisher.Err
+	}
+	senderErrs := make(map[string]error)
+	for key, s := range Senders {
+		senderErrs[key] = s.Err
+	}
+	Mutex.Unlock()
+
 	if Receiver != nil {
-		if Receiver.Err != nil {
-			Warn("Deleting Receiver due to error: %v", Receiver.Err)
+		if err := receiverErr; err != nil {
+			Event(LevelWarn, Attrs{"event": "receiver_delete", "group": Group.String(), "error": err}, "Deleting Receiver due to error: %v", err)
 			Receiver.Close()
 			Receiver = nil
 		}
 	}
 
+	if Publisher != nil {
+		if err := publisherErr; err != nil {
+			Event(LevelWarn, Attrs{"event": "publisher_delete", "error": err}, "Deleting Publisher due to error: %v", err)
+			Publisher.Close()
+			Mutex.Lock()
+			Publisher = nil
+			Mutex.Unlock()
+		}
+	}
+
 	for key, s := range Senders {
-		if s.Err != nil {
-			Warn("Deleting %s due to error: %v", key, s.Err)
+		if err := senderErrs[key]; err != nil {
+			Event(LevelWarn, Attrs{"event": "sender_delete", "interface": s.Iface.Name, "address": s.IP.String(), "error": err}, "Deleting %s due to error: %v", key, err)
 			s.Close()
+			Mutex.Lock()
 			delete(Senders, key)
+			Mutex.Unlock()
 		}
 	}
+
+	CheckRawSockets(false)
+	CheckCollectors()
 }
 
 func MakeSockets() {
-	MakeReceiver()
-	MakeSenders()
+	MakeCollectors()
+	if Role == "collector" {
+		MakeCollectorListeners()
+		return
+	}
+
+	ifaces, addrs := GetUsableInterfaces()
+	PruneSockets(ifaces, addrs)
+	if Role != "beacon" {
+		MakeReceiver(ifaces)
+	}
+	if Role != "listener" {
+		MakeSenders(ifaces, addrs)
+	} else if Unicast {
+		MakePublisher()
+	}
+	if PimEnabled {
+		MakePim(ifaces)
+	}
+	if IgmpEnabled {
+		MakeIgmp(ifaces)
+	}
+	if QuerierRegex != "" {
+		SendQueries(ifaces)
+	}
+	if CapSize {
+		CapPadding()
+	}
+	CheckMTUs()
+}
+
+// PruneSockets reconciles existing sockets against the usable interfaces and addresses
+func PruneSockets(ifaces []net.Interface, addrs map[int][]net.IP) {
+	usable := make(map[string]bool)
+	joinable := make(map[int]bool)
+	for _, iface := range ifaces {
+		joinable[iface.Index] = true
+		for _, ip := range addrs[iface.Index] {
+			usable[SenderKey(iface, ip)] = true
+		}
+	}
+
+	// Delete senders for addresses that no longer exist or no longer match the filters
+	for key, s := range Senders {
+		var reason, why string
+		switch {
+		case Role == "listener":
+			reason, why = "role is listener", "listeners do not send to the group"
+		case !usable[key]:
+			reason, why = "address no longer usable", "the address is no longer usable"
+		}
+		if reason != "" {
+			Event(LevelInfo, Attrs{"event": "sender_delete", "interface": s.Iface.Name, "address": s.IP.String(), "reason": reason}, "Deleting %s because %s", key, why)
+			s.Close()
+			Mutex.Lock()
+			delete(Senders, key)
+			Mutex.Unlock()
+		}
+	}
+
+	// Leave the group on interfaces that are no longer usable
+	if Receiver != nil {
+		for index, iface := range Receiver.Joined {
+			if joinable[index] {
+				continue
+			}
+			delete(Receiver.Joined, index)
+			if _, err := net.InterfaceByIndex(index); err != nil {
+				Event(LevelInfo, Attrs{"event": "group_leave", "interface": iface.Name, "group": Group.String(), "reason": "interface no longer exists"}, "Receiver: %s no longer exists", iface.Name)
+				continue
+			}
+			Event(LevelInfo, Attrs{"event": "group_leave", "interface": iface.Name, "group": Group.String(), "reason": "interface no longer usable"}, "Receiver: leaving group %s on %s because the interface is no longer usable", Group, iface.Name)
+			err := Receiver.LeaveGroup(iface, Group)
+			if err != nil {
+				Debug("Receiver: LeaveGroup(%s, %s): %v", iface.Name, Group, err)
+			}
+		}
+	}
+}
+
+// Notify wakes the socket loop without blocking, coalescing bursts of changes
+func Notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
 }
 
-func MakeReceiver() {
+func MakeReceiver(ifaces []net.Interface) {
 	var err error
 
 	if Receiver == nil {
-		Info("Making Receiver for address %s port %d", Group.String(), Port)
+		Event(LevelInfo, Attrs{"event": "receiver_create", "group": Group.String(), "port": Port}, "Making Receiver for address %s port %d", Group.String(), Port)
 		s := &Socket{
-			IP: Group,
+			IP:     Group,
+			Joined: make(map[int]net.Interface),
 		}
 
 		// By joining the group instead of the wildcard address, multiple instances of macy can receive reports at the same time
 		a := net.UDPAddr{IP: Group, Port: Port}
 		s.Conn, s.Err = net.ListenUDP(Transport, &a)
 		if s.Err != nil {
-			Warn("Receiver: net.ListenUDP(%s, %v): %v", Transport, a, s.Err)
+			Event(LevelWarn, Attrs{"event": "receiver_error", "group": Group.String(), "error": s.Err}, "Receiver: net.ListenUDP(%s, %v): %v", Transport, a, s.Err)
 		}
 
 		if s.Conn != nil {
@@ -111,36 +344,58 @@ func MakeReceiver() {
 				if err != nil {
 					Warn("Receiver: Conn4.SetMulticastLoopback(true): %v", err)
 				}
+				err = s.Conn4.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst|ipv4.FlagTTL, true)
+				if err != nil {
+					Debug("Receiver: Conn4.SetControlMessage: %v", err)
+				}
 			case "udp6":
 				s.Conn6 = ipv6.NewPacketConn(s.Conn)
 				err = s.Conn6.SetMulticastLoopback(true)
 				if err != nil {
 					Warn("Receiver: Conn6.SetMulticastLoopback(true): %v", err)
 				}
+				err = s.Conn6.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst|ipv6.FlagHopLimit, true)
+				if err != nil {
+					Debug("Receiver: Conn6.SetControlMessage: %v", err)
+				}
 			}
 
 			go func() {
 				b := make([]byte, 70000)
 				var n int
 				var from *net.UDPAddr
+				var arrival Arrival
 				var t time.Time
 				var r *Report
+				var err error
 				for {
-					n, from, s.Err = s.Conn.ReadFromUDP(b)
-					t = time.Now()
-					if n > 0 {
+					n, from, arrival, err = s.ReadFrom(b)
+					t = Now()
+					if n > 0 && from != nil {
 						r = Decode(b[:n])
 						if r == nil {
 							continue
 						}
+						dst := net.UDPAddr{IP: arrival.Dst, Port: Port}
+						if dst.IP == nil {
+							dst.IP = Group
+						}
+						Capture.Write(from, &dst, arrival.TTL, 0, false, PcapInbound, b[:n], t)
+						Recording.Report(IngressGroup, from, arrival.IfIndex, arrival.Dst, b[:n], t)
 						Mutex.Lock()
-						HeardHosts[r.Host] = t
-						HeardIPs[from.IP.String()] = t
-						HeardDb[r.Host] = r.Heard
+						StoreReceived(r, from, t)
 						Mutex.Unlock()
 					}
-					if s.Err != nil {
-						Warn("Receiver: Conn.ReadFromUDP(b): %v", s.Err)
+					if err != nil {
+						Mutex.Lock()
+						closed, group := s.Closed, Group
+						if !closed {
+							s.Err = err
+						}
+						Mutex.Unlock()
+						if !closed {
+							Event(LevelWarn, Attrs{"event": "receiver_error", "group": group.String(), "error": err}, "Receiver: ReadFrom(b): %v", err)
+						}
 						return
 					}
 				}
@@ -153,25 +408,34 @@ func MakeReceiver() {
 	// Interfaces come and go, and there's no way to see if our socket is joined to the group on a particular interface, so rejoin on all usable interfaces on each loop.
 	if Receiver != nil {
 		a := net.UDPAddr{IP: Group}
-		for _, iface := range GetUsableInterfaces() {
+		for _, iface := range ifaces {
 			switch Transport {
 			case "udp4":
 				err = Receiver.Conn4.JoinGroup(&iface, &a)
-				if err != nil { //nolint:staticcheck
-					// This appears to generate errors if Conn4 is already joined
-				}
 			case "udp6":
 				err = Receiver.Conn6.JoinGroup(&iface, &a)
-				if err != nil { //nolint:staticcheck
-					// This appears to generate errors if Conn6 is already joined
+			}
+			key := fmt.Sprintf("%d %s join", iface.Index, iface.Name)
+			if _, ok := Receiver.Joined[iface.Index]; !ok {
+				// Joining again appears to generate errors once joined, so only a failed first join counts, and is retried on the next loop
+				if err != nil {
+					msg := fmt.Sprintf("Receiver: JoinGroup(%s, %s): %v", iface.Name, Group, err)
+					if LogCandidates[key] != msg {
+						LogCandidates[key] = msg
+						Event(LevelWarn, Attrs{"event": "group_join_error", "interface": iface.Name, "group": Group.String(), "error": err}, "%s", msg)
+					}
+					continue
 				}
+				delete(LogCandidates, key)
+				Debug("Receiver: joined group %s on %s", Group, iface.Name)
 			}
+			Receiver.Joined[iface.Index] = iface
 
 			groups, err := iface.MulticastAddrs()
 			if err != nil {
 				Warn("%s.MulticastAddrs(): %v", iface.Name, err)
 			}
-			key := fmt.Sprintf("%d %s groups", iface.Index, iface.Name)
+			key = fmt.Sprintf("%d %s groups", iface.Index, iface.Name)
 			msg := fmt.Sprintf("Multicast groups joined on %s: %v", iface.Name, groups)
 			if LogCandidates[key] != msg {
 				LogCandidates[key] = msg
@@ -181,18 +445,19 @@ func MakeReceiver() {
 	}
 }
 
-func MakeSenders() {
-	for _, iface := range GetUsableInterfaces() {
-		for _, ip := range GetUsableIPs(iface) {
-			key := fmt.Sprintf("Sender for interface %d(%s) address %s", iface.Index, iface.Name, ip.String())
+func MakeSenders(ifaces []net.Interface, addrs map[int][]net.IP) {
+	for _, iface := range ifaces {
+		for _, ip := range addrs[iface.Index] {
+			key := SenderKey(iface, ip)
 			if Senders[key] != nil {
 				continue
 			}
 
-			Info("Making %s", key)
+			Event(LevelInfo, Attrs{"event": "sender_create", "interface": iface.Name, "address": ip.String(), "ttl": TTL, "qos": QoS}, "Making %s", key)
 			s := &Socket{
 				Iface: iface,
 				IP:    ip,
+				TTL:   TTL,
 			}
 
 			a := net.UDPAddr{IP: ip}
@@ -201,7 +466,10 @@ func MakeSenders() {
 			}
 			s.Conn, s.Err = net.ListenUDP(Transport, &a)
 			if s.Err != nil {
-				Warn("%s: net.ListenUDP(%s, %v): %v", key, Transport, a, s.Err)
+				Event(LevelWarn, Attrs{"event": "sender_error", "interface": iface.Name, "address": ip.String(), "error": s.Err}, "%s: net.ListenUDP(%s, %v): %v", key, Transport, a, s.Err)
+				Mutex.Lock()
+				SenderErrors[key]++
+				Mutex.Unlock()
 			}
 
 			if s.Conn != nil {
@@ -240,18 +508,6 @@ func MakeSenders() {
 					if err != nil {
 						Warn("%s: Conn4.SetMulticastInterface(%s) = %v", key, iface.Name, err)
 					}
-
-					// Convenience function for sending packets to the multicast Group
-					s.Send = func(b []byte) {
-						a := net.UDPAddr{IP: Group, Port: Port}
-						_, err := s.Conn4.WriteTo(b, nil, &a)
-						if err != nil {
-							Warn("%s: %v", key, err)
-							if !errors.Is(err, syscall.EMSGSIZE) {
-								s.Err = err
-							}
-						}
-					}
 				case "udp6":
 					// Set the DF-bit
 					err = rawConn.Control(func(fd uintptr) {
@@ -279,54 +535,146 @@ func MakeSenders() {
 					if err != nil {
 						Debug("%s: Conn6.SetMulticastInterface(%s) = %v", key, iface.Name, err)
 					}
+				}
 
-					// Convenience function for sending packets to the multicast Group
-					s.Send = func(b []byte) {
-						a := net.UDPAddr{IP: Group, Port: Port}
-						_, err := s.Conn6.WriteTo(b, nil, &a)
-						if err != nil {
-							Warn("%s: %v", key, err)
-							if !errors.Is(err, syscall.EMSGSIZE) {
-								s.Err = err
-							}
+				// Convenience function for sending packets to the multicast Group
+				s.Send = func(b []byte) {
+					err := s.WriteGroup(b)
+					if err != nil {
+						Event(LevelWarn, Attrs{"event": "sender_error", "interface": iface.Name, "address": ip.String(), "error": err}, "%s: %v", key, err)
+						SenderErrors[key]++
+						if !errors.Is(err, syscall.EMSGSIZE) {
+							s.Err = err
 						}
 					}
 				}
 
+				// Listeners reply to senders with unicast reports
 				go func() {
 					b := make([]byte, 70000)
 					var n int
 					var from *net.UDPAddr
+					var r *Report
+					var err error
 					for {
-						n, from, s.Err = s.Conn.ReadFromUDP(b)
+						n, from, err = s.Conn.ReadFromUDP(b)
 						if n > 0 {
-							Warn("%s: unexpected packet received from %v: %x", key, from, b[:n])
+							r = Decode(b[:n])
+							if r == nil {
+								Warn("%s: unexpected packet received from %v: %x", key, from, b[:n])
+							} else {
+								t := Now()
+								Capture.Write(from, s.Conn.LocalAddr().(*net.UDPAddr), PcapUnknownTTL, 0, false, PcapInbound, b[:n], t)
+								Recording.Report(IngressUnicast, from, iface.Index, ip, b[:n], t)
+								Mutex.Lock()
+								StoreReport(r, t)
+								Mutex.Unlock()
+							}
 						}
-						if s.Err != nil {
-							Warn("%s: Conn.ReadFromUDP(b): %v", key, s.Err)
+						if err != nil {
+							// Senders closed by PruneSockets or ApplySettings are not failures
+							Mutex.Lock()
+							closed := s.Closed
+							if !closed {
+								s.Err = err
+								SenderErrors[key]++
+							}
+							Mutex.Unlock()
+							if !closed {
+								Event(LevelWarn, Attrs{"event": "sender_error", "interface": iface.Name, "address": ip.String(), "error": err}, "%s: Conn.ReadFromUDP(b): %v", key, err)
+							}
 							return
 						}
 					}
 				}()
 
+				Mutex.Lock()
 				Senders[key] = s
+				Mutex.Unlock()
 			}
 		}
 	}
 }
 
-func GetUsableInterfaces() (usable []net.Interface) {
+// MakePublisher creates the socket listeners use to send reports by unicast to the senders they hear
+func MakePublisher() {
+	if Publisher != nil {
+		return
+	}
+
+	Event(LevelInfo, Attrs{"event": "publisher_create"}, "Making Publisher for unicast reports")
+	s := &Socket{}
+	s.Conn, s.Err = net.ListenUDP(Transport, nil)
+	if s.Err != nil {
+		Warn("Publisher: net.ListenUDP(%s, nil): %v", Transport, s.Err)
+		return
+	}
+	Debug("Publisher: Conn.LocalAddr = %v", s.Conn.LocalAddr())
+
+	s.SendTo = func(b []byte, a *net.UDPAddr) {
+		_, err := s.Conn.WriteToUDP(b, a)
+		if err == nil {
+			Capture.Write(s.Conn.LocalAddr().(*net.UDPAddr), a, PcapUnknownTTL, 0, false, PcapOutbound, b, time.Now())
+		} else {
+			Warn("Publisher: %v: %v", a, err)
+			if !errors.Is(err, syscall.EMSGSIZE) {
+				s.Err = err
+			}
+		}
+	}
+
+	go func() {
+		b := make([]byte, 70000)
+		var n int
+		var from *net.UDPAddr
+		var err error
+		for {
+			n, from, err = s.Conn.ReadFromUDP(b)
+			if n > 0 {
+				Warn("Publisher: unexpected packet received from %v: %x", from, b[:n])
+			}
+			if err != nil {
+				Mutex.Lock()
+				closed := s.Closed
+				if !closed {
+					s.Err = err
+				}
+				Mutex.Unlock()
+				if !closed {
+					Warn("Publisher: Conn.ReadFromUDP(b): %v", err)
+				}
+				return
+			}
+		}
+	}()
+
+	Mutex.Lock()
+	Publisher = s
+	Mutex.Unlock()
+}
+
+func SenderKey(iface net.Interface, ip net.IP) string {
+	return fmt.Sprintf("Sender for interface %d(%s) address %s", iface.Index, iface.Name, ip.String())
+}
+
+// GetUsableInterfaces also returns the usable addresses of each interface, indexed by interface index, so they are only read once per pass, and records why the others cannot be used
+func GetUsableInterfaces() (usable []net.Interface, addrs map[int][]net.IP) {
+	addrs = make(map[int][]net.IP)
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		Warn("net.Interfaces: %v", err)
-		return nil
+		return nil, addrs
 	}
 
 	var key, msg string
+	states := make(map[string]*InterfaceState)
 	for _, iface := range ifaces {
+		state := &InterfaceState{Name: iface.Name, Index: iface.Index, MTU: iface.MTU, Flags: iface.Flags.String()}
+		states[iface.Name] = state
 		match, err := InterfaceFilter.MatchString(iface.Name)
 		if err != nil {
 			Warn("InterfaceFilter.MatchString(%s): %v", iface.Name, err)
+			state.Reason = err.Error()
 			continue
 		}
 		if !match {
@@ -336,6 +684,7 @@ func GetUsableInterfaces() (usable []net.Interface) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			state.Reason = msg
 			continue
 		}
 		if iface.Flags&net.FlagUp == 0 {
@@ -345,6 +694,7 @@ func GetUsableInterfaces() (usable []net.Interface) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			state.Reason = msg
 			continue
 		}
 		if iface.Flags&net.FlagMulticast == 0 {
@@ -354,15 +704,22 @@ func GetUsableInterfaces() (usable []net.Interface) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			state.Reason = msg
 			continue
 		}
-		if len(GetUsableIPs(iface)) == 0 {
+		ips, rejected := GetUsableIPs(iface)
+		state.Rejected = rejected
+		for _, ip := range ips {
+			state.Addresses = append(state.Addresses, ip.String())
+		}
+		if len(ips) == 0 {
 			key = fmt.Sprintf("%d %s addresses", iface.Index, iface.Name)
 			msg = fmt.Sprintf("%s has no usable addresses", iface.Name)
 			if LogCandidates[key] != msg {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			state.Reason = msg
 			continue
 		}
 
@@ -372,17 +729,24 @@ func GetUsableInterfaces() (usable []net.Interface) {
 			LogCandidates[key] = msg
 			Debug(msg)
 		}
+		state.Usable = true
 		usable = append(usable, iface)
+		addrs[iface.Index] = ips
 	}
 
-	return usable
+	Mutex.Lock()
+	InterfaceStates = states
+	Mutex.Unlock()
+	return usable, addrs
 }
 
-func GetUsableIPs(iface net.Interface) (usable []net.IP) {
+// GetUsableIPs also returns why each of the other addresses of the interface cannot be used
+func GetUsableIPs(iface net.Interface) (usable []net.IP, rejected map[string]string) {
+	rejected = make(map[string]string)
 	addrs, err := iface.Addrs()
 	if err != nil {
 		Warn("%s.Addrs: %v", iface.Name, err)
-		return nil
+		return nil, rejected
 	}
 
 	var key, msg string
@@ -402,6 +766,7 @@ func GetUsableIPs(iface net.Interface) (usable []net.IP) {
 		match, err := AddressFilter.MatchString(ipstr)
 		if err != nil {
 			Warn("AddressFilter.MatchString(%s): %v", ipstr, err)
+			rejected[ipstr] = err.Error()
 			continue
 		}
 		if !match {
@@ -411,6 +776,7 @@ func GetUsableIPs(iface net.Interface) (usable []net.IP) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			rejected[ipstr] = msg
 			continue
 		}
 		if Transport == "udp4" && ip.To4() == nil {
@@ -420,6 +786,7 @@ func GetUsableIPs(iface net.Interface) (usable []net.IP) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			rejected[ipstr] = msg
 			continue
 		}
 		if Transport == "udp6" && ip.To4() != nil {
@@ -429,6 +796,7 @@ func GetUsableIPs(iface net.Interface) (usable []net.IP) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			rejected[ipstr] = msg
 			continue
 		}
 		if !LinkLocal && ip.IsLinkLocalUnicast() {
@@ -438,6 +806,7 @@ func GetUsableIPs(iface net.Interface) (usable []net.IP) {
 				LogCandidates[key] = msg
 				Debug(msg)
 			}
+			rejected[ipstr] = msg
 			continue
 		}
 
@@ -450,5 +819,5 @@ func GetUsableIPs(iface net.Interface) (usable []net.IP) {
 		usable = append(usable, ip)
 	}
 
-	return usable
+	return usable, rejected
 }
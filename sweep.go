@@ -0,0 +1,203 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"code.rocketnine.space/tslocum/cview"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Data, guarded by Mutex. SweepTTLs and SweepSizes hold the last time each stamped TTL or probe size was heard on the group from each IP, HeardTTLs and HeardSizes what each host reports for each IP, and SweepSeqs the Seq of the report they came from.
+	SweepTTLs  = make(map[string]map[int]time.Time)
+	HeardTTLs  = make(map[string]map[string]int)
+	SweepSizes = make(map[string]map[int]time.Time)
+	HeardSizes = make(map[string]map[string]int)
+	SweepSeqs  = make(map[string]uint32)
+
+	Sweep = cview.NewTextView()
+)
+
+// RecordTTL records a report stamped with the TTL it was sent with. Mutex must be held.
+func RecordTTL(ip string, ttl int, t time.Time) {
+	if SweepTTLs[ip] == nil {
+		SweepTTLs[ip] = make(map[int]time.Time)
+	}
+	SweepTTLs[ip][ttl] = t
+}
+
+// MinTTLs returns the smallest TTL heard from each IP within the history length, so the result follows routing changes. Mutex must be held.
+func MinTTLs(now time.Time) map[string]int {
+	z := make(map[string]int)
+	for ip, ttls := range SweepTTLs {
+		for ttl, t := range ttls {
+			if now.Sub(t) > HistoryLength {
+				continue
+			}
+			if min, ok := z[ip]; !ok || ttl < min {
+				z[ip] = ttl
+			}
+		}
+	}
+	return z
+}
+
+// StoreSweeps records the minimum TTLs and largest probe sizes a host reports, where each part of a multi-part report holds some of them.
+// Like Partials, the first part heard of a new report replaces the previous one, so IPs the host no longer reports are dropped. Mutex must be held.
+func StoreSweeps(r *Report) {
+	if seq, ok := SweepSeqs[r.Host]; !ok || seq != r.Seq {
+		SweepSeqs[r.Host] = r.Seq
+		HeardTTLs[r.Host] = make(map[string]int)
+		HeardSizes[r.Host] = make(map[string]int)
+	}
+	for ip, ttl := range r.MinTTL {
+		HeardTTLs[r.Host][ip] = ttl
+	}
+	for ip, size := range r.Largest {
+		HeardSizes[r.Host][ip] = size
+	}
+}
+
+// RecordSize records a probe of size heard on the group. Mutex must be held.
+func RecordSize(ip string, size int, t time.Time) {
+	if SweepSizes[ip] == nil {
+		SweepSizes[ip] = make(map[int]time.Time)
+	}
+	SweepSizes[ip][size] = t
+}
+
+// LargestSizes returns the largest probe heard from each IP within the history length. Mutex must be held.
+func LargestSizes(now time.Time) map[string]int {
+	z := make(map[string]int)
+	for ip, sizes := range SweepSizes {
+		for size, t := range sizes {
+			if now.Sub(t) <= HistoryLength && size > z[ip] {
+				z[ip] = size
+			}
+		}
+	}
+	return z
+}
+
+// HeaderSize returns the size of the IP and UDP headers of a datagram from ip
+func HeaderSize(ip string) int {
+	if strings.Contains(ip, ":") {
+		return 48
+	}
+	return 28
+}
+
+// SweepMatrix returns the sources and hosts with results, and the owner of each source. Mutex must be held.
+func SweepMatrix(results map[string]map[string]int) (ips []string, hosts []string, owner map[string]string) {
+	seen := make(map[string]bool)
+	for host, values := range results {
+		if len(values) > 0 {
+			hosts = append(hosts, host)
+		}
+		for ip := range values {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	sort.Slice(ips, func(i, j int) bool { return IPLess(ips[i], ips[j]) })
+	owner = make(map[string]string)
+	for _, ip := range ips {
+		owner[ip] = HostIPs[ip]
+	}
+	return ips, hosts, owner
+}
+
+// WriteMatrix writes a table with a row for each source and a column for each host
+func WriteMatrix(b *strings.Builder, ips []string, hosts []string, owner map[string]string, cell func(ip string, host string) string) {
+	width := len("Source")
+	for _, ip := range ips {
+		if w := len(ip) + len(owner[ip]) + 3; w > width {
+			width = w
+		}
+	}
+	widths := make(map[string]int)
+	fmt.Fprintf(b, "  %-*s", width, "Source")
+	for _, host := range hosts {
+		widths[host] = len(host)
+		if widths[host] < 8 {
+			widths[host] = 8
+		}
+		fmt.Fprintf(b, " %*s", widths[host], host)
+	}
+	b.WriteString("\n")
+	for _, ip := range ips {
+		label := ip
+		if owner[ip] != "" {
+			label = fmt.Sprintf("%s (%s)", ip, owner[ip])
+		}
+		fmt.Fprintf(b, "  %-*s", width, label)
+		for _, host := range hosts {
+			fmt.Fprintf(b, " %*s", widths[host], cell(ip, host))
+		}
+		b.WriteString("\n")
+	}
+}
+
+// SweepSummary describes the results of sweeps. Mutex must be held.
+func SweepSummary() string {
+	var b strings.Builder
+	b.WriteString("Minimum TTL heard, by source and receiving host\n")
+	if TTLSweep > 0 {
+		fmt.Fprintf(&b, "This instance sweeps TTLs 1 to %d\n", TTLSweep)
+	}
+	b.WriteString("\n")
+	ips, hosts, owner := SweepMatrix(HeardTTLs)
+	if len(ips) == 0 {
+		b.WriteString("  No stamped reports heard, use --ttlsweep on the senders\n")
+	} else {
+		WriteMatrix(&b, ips, hosts, owner, func(ip string, host string) string {
+			if ttl, ok := HeardTTLs[host][ip]; ok {
+				return fmt.Sprint(ttl)
+			}
+			return ""
+		})
+	}
+
+	b.WriteString("\nLargest packet heard with the DF-bit set, including IP and UDP headers, by source and receiving host\n")
+	if len(MTUSweep) > 0 {
+		fmt.Fprintf(&b, "This instance sends probes of %v bytes\n", MTUSweep)
+	}
+	b.WriteString("\n")
+	ips, hosts, owner = SweepMatrix(HeardSizes)
+	if len(ips) == 0 {
+		b.WriteString("  No probes heard, use --mtusweep on the senders\n")
+	} else {
+		WriteMatrix(&b, ips, hosts, owner, func(ip string, host string) string {
+			if size, ok := HeardSizes[host][ip]; ok {
+				return fmt.Sprint(size + HeaderSize(ip))
+			}
+			return ""
+		})
+	}
+	return b.String()
+}
+
+func UpdateSweep() {
+	Mutex.Lock()
+	text := SweepSummary()
+	Mutex.Unlock()
+	Sweep.SetText(cview.Escape(text))
+}
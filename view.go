@@ -15,16 +15,37 @@
 package main
 
 import (
+	"bytes"
 	"code.rocketnine.space/tslocum/cview"
 	"fmt"
+	"github.com/dlclark/regexp2"
 	"github.com/gdamore/tcell/v2"
+	"net"
 	"sort"
+	"strings"
 	"time"
 )
 
 var (
-	Log     = cview.NewTextView()
-	Reports = cview.NewTable()
+	Log      = cview.NewTextView()
+	Reports  = cview.NewTable()
+	Problems = cview.NewTextView()
+	Hosts    = cview.NewTable()
+
+	// Source host shown on each row of the Hosts table, and which hosts are expanded to show their IPs
+	HostRows      []string
+	HostsExpanded = make(map[string]bool)
+
+	// Reports view filters and sort order
+	LogSearchField = cview.NewInputField()
+	IPSearch       = cview.NewInputField()
+	HostSearch     = cview.NewInputField()
+	IPSearchRe     *regexp2.Regexp
+	HostSearchRe   *regexp2.Regexp
+	SearchTimeouts = make(map[*regexp2.Regexp]bool)
+	ProblemsOnly   bool
+	SortOrder      int
+	SortOrders     = []string{"address", "host", "staleness", "text"}
 )
 
 func View() {
@@ -34,6 +55,7 @@ func View() {
 	Log.SetScrollBarColor(tcell.ColorGrey)
 	Log.ScrollToEnd()
 	Log.SetDynamicColors(true)
+	Log.SetMaxLines(LogLimit)
 
 	Reports.SetBorder(true)
 	Reports.SetBorderColor(tcell.ColorGrey)
@@ -43,6 +65,159 @@ func View() {
 	Reports.SetSeparator(cview.Borders.Vertical)
 	Reports.SetBordersColor(tcell.ColorGrey)
 
+	// Regex filters for the Reports view, Tab switches between them and Enter or Escape returns to the table
+	var app *cview.Application
+	search := func(field *cview.InputField, re **regexp2.Regexp, label string) {
+		field.SetLabel(label + ": ")
+		field.SetFieldBackgroundColor(tcell.ColorBlack)
+		field.SetFieldBackgroundColorFocused(tcell.ColorGrey)
+		field.SetChangedFunc(func(text string) {
+			var compiled *regexp2.Regexp
+			var err error
+			if text != "" {
+				compiled, err = CompileFilter(text)
+			}
+			if err != nil {
+				field.SetLabel(label + " (invalid): ")
+			} else {
+				field.SetLabel(label + ": ")
+			}
+			Mutex.Lock()
+			delete(SearchTimeouts, *re)
+			*re = compiled
+			Mutex.Unlock()
+			UpdateReports()
+		})
+		field.SetDoneFunc(func(key tcell.Key) {
+			switch key {
+			case tcell.KeyTab, tcell.KeyBacktab:
+				if field == IPSearch {
+					app.SetFocus(HostSearch)
+				} else {
+					app.SetFocus(IPSearch)
+				}
+			default:
+				app.SetFocus(Reports)
+			}
+		})
+	}
+	search(IPSearch, &IPSearchRe, "IPs")
+	search(HostSearch, &HostSearchRe, "Hosts")
+	// Text search for the Log view
+	LogSearchField.SetLabel("Search: ")
+	LogSearchField.SetFieldBackgroundColor(tcell.ColorBlack)
+	LogSearchField.SetFieldBackgroundColorFocused(tcell.ColorGrey)
+	LogSearchField.SetChangedFunc(func(text string) {
+		LogMutex.Lock()
+		LogSearch = strings.ToLower(text)
+		LogMutex.Unlock()
+		RefreshLog()
+	})
+	LogSearchField.SetDoneFunc(func(key tcell.Key) {
+		app.SetFocus(Log)
+	})
+	logs := cview.NewFlex()
+	logs.SetDirection(cview.FlexRow)
+	logs.AddItem(LogSearchField, 1, 0, false)
+	logs.AddItem(Log, 0, 1, true)
+	LogTitle()
+
+	filters := cview.NewFlex()
+	filters.AddItem(IPSearch, 0, 1, false)
+	filters.AddItem(HostSearch, 0, 1, false)
+	reports := cview.NewFlex()
+	reports.SetDirection(cview.FlexRow)
+	reports.AddItem(filters, 1, 0, false)
+	reports.AddItem(Reports, 0, 1, true)
+
+	Hosts.SetBorder(true)
+	Hosts.SetBorderColor(tcell.ColorGrey)
+	Hosts.ShowFocus(false)
+	Hosts.SetScrollBarColor(tcell.ColorGrey)
+	Hosts.SetFixed(1, 1)
+	Hosts.SetSeparator(cview.Borders.Vertical)
+	Hosts.SetBordersColor(tcell.ColorGrey)
+	Hosts.SetSelectable(true, false)
+	Hosts.SetSelectedFunc(func(row, column int) {
+		Mutex.Lock()
+		if row > 0 && row < len(HostRows) {
+			HostsExpanded[HostRows[row]] = !HostsExpanded[HostRows[row]]
+		}
+		Mutex.Unlock()
+		UpdateHosts()
+	})
+
+	Graphs.SetBorder(true)
+	Graphs.SetBorderColor(tcell.ColorGrey)
+	Graphs.ShowFocus(false)
+	Graphs.SetScrollBarColor(tcell.ColorGrey)
+	Graphs.SetFixed(1, 1)
+	Graphs.SetSeparator(' ')
+
+	Pim.SetBorder(true)
+	Pim.SetBorderColor(tcell.ColorGrey)
+	Pim.ShowFocus(false)
+	Pim.SetScrollBarColor(tcell.ColorGrey)
+
+	Queriers.SetBorder(true)
+	Queriers.SetBorderColor(tcell.ColorGrey)
+	Queriers.ShowFocus(false)
+	Queriers.SetScrollBarColor(tcell.ColorGrey)
+
+	Interfaces.SetBorder(true)
+	Interfaces.SetBorderColor(tcell.ColorGrey)
+	Interfaces.ShowFocus(false)
+	Interfaces.SetScrollBarColor(tcell.ColorGrey)
+
+	Sweep.SetBorder(true)
+	Sweep.SetBorderColor(tcell.ColorGrey)
+	Sweep.ShowFocus(false)
+	Sweep.SetScrollBarColor(tcell.ColorGrey)
+
+	Trace.SetBorder(true)
+	Trace.SetBorderColor(tcell.ColorGrey)
+	Trace.ShowFocus(false)
+	Trace.SetScrollBarColor(tcell.ColorGrey)
+	TraceHelp()
+
+	// Source and router fields for the Trace view, Tab switches between them and Enter starts the trace
+	for _, field := range []*cview.InputField{TraceSource, TraceRouter} {
+		field := field
+		field.SetFieldBackgroundColor(tcell.ColorBlack)
+		field.SetFieldBackgroundColorFocused(tcell.ColorGrey)
+		field.SetDoneFunc(func(key tcell.Key) {
+			switch key {
+			case tcell.KeyTab, tcell.KeyBacktab:
+				if field == TraceSource {
+					app.SetFocus(TraceRouter)
+				} else {
+					app.SetFocus(TraceSource)
+				}
+			case tcell.KeyEnter:
+				StartTrace()
+				app.SetFocus(Trace)
+			default:
+				app.SetFocus(Trace)
+			}
+		})
+	}
+	TraceSource.SetLabel("Source: ")
+	TraceRouter.SetLabel("Router: ")
+	TraceRouter.SetText(MtraceRouter)
+	traceFields := cview.NewFlex()
+	traceFields.AddItem(TraceSource, 0, 1, false)
+	traceFields.AddItem(TraceRouter, 0, 1, false)
+	trace := cview.NewFlex()
+	trace.SetDirection(cview.FlexRow)
+	trace.AddItem(traceFields, 1, 0, false)
+	trace.AddItem(Trace, 0, 1, true)
+
+	Problems.SetBorder(true)
+	Problems.SetBorderColor(tcell.ColorGrey)
+	Problems.ShowFocus(false)
+	Problems.SetScrollBarColor(tcell.ColorGrey)
+	Problems.SetDynamicColors(true)
+
 	about := cview.NewTextView()
 	about.SetBorder(true)
 	about.SetBorderColor(tcell.ColorGrey)
@@ -59,21 +234,129 @@ func View() {
 	panels.SetTabBackgroundColor(tcell.ColorBlack)
 	panels.SetTabTextColorFocused(tcell.ColorWhite)
 	panels.SetTabBackgroundColorFocused(tcell.ColorGrey)
-	panels.AddTab("Reports", "(R)eports", Reports)
-	panels.AddTab("Log", "(L)og", Log)
+	panels.AddTab("Reports", "(R)eports", reports)
+	panels.AddTab("Hosts", "(H)osts", Hosts)
+	panels.AddTab("Problems", "(P)roblems", Problems)
+	panels.AddTab("Graphs", "(G)raphs", Graphs)
+	panels.AddTab("Interfaces", "(I)nterfaces", Interfaces)
+	if PimEnabled {
+		panels.AddTab("PIM", "PI(M)", Pim)
+	}
+	if IgmpEnabled {
+		panels.AddTab("Queriers", "Q(u)eriers", Queriers)
+	}
+	panels.AddTab("Sweep", "S(w)eep", Sweep)
+	panels.AddTab("Trace", "(T)race", trace)
+	panels.AddTab("Settings", "S(e)ttings", MakeSettingsView())
+	panels.AddTab("Log", "(L)og", logs)
 	panels.AddTab("About", "(A)bout", about)
 	panels.AddTab("Quit", "(Q)uit", quit)
 	panels.SetCurrentTab("Reports")
 
-	app := cview.NewApplication()
+	app = cview.NewApplication()
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		// Keys typed into a search field are not shortcuts
+		if _, ok := app.GetFocus().(*cview.InputField); ok {
+			return event
+		}
+
+		if panels.GetCurrentTab() == "Reports" {
+			switch event.Rune() {
+			case '/':
+				app.SetFocus(IPSearch)
+				return nil
+			case 'o', 'O':
+				Mutex.Lock()
+				ProblemsOnly = !ProblemsOnly
+				Mutex.Unlock()
+				UpdateReports()
+				return nil
+			case 's', 'S':
+				Mutex.Lock()
+				SortOrder = (SortOrder + 1) % len(SortOrders)
+				Mutex.Unlock()
+				UpdateReports()
+				return nil
+			}
+		}
+
+		if panels.GetCurrentTab() == "Log" {
+			switch event.Rune() {
+			case '/':
+				app.SetFocus(LogSearchField)
+				return nil
+			case 'v', 'V':
+				LogMutex.Lock()
+				LogLevel = (LogLevel + 1) % LevelFatal
+				LogMutex.Unlock()
+				LogTitle()
+				RefreshLog()
+				return nil
+			}
+		}
+
+		if panels.GetCurrentTab() == "Trace" {
+			switch event.Rune() {
+			case '/':
+				app.SetFocus(TraceSource)
+				return nil
+			}
+		}
+
+		if panels.GetCurrentTab() == "Graphs" {
+			switch event.Rune() {
+			case 'b', 'B':
+				Mutex.Lock()
+				GraphsByHost = !GraphsByHost
+				Mutex.Unlock()
+				UpdateGraphs()
+				return nil
+			}
+		}
+
 		switch event.Rune() {
 		case 'r', 'R':
 			panels.SetCurrentTab("Reports")
+		case 'h', 'H':
+			panels.SetCurrentTab("Hosts")
+		case 'p', 'P':
+			panels.SetCurrentTab("Problems")
+		case 'g', 'G':
+			panels.SetCurrentTab("Graphs")
+		case 'i', 'I':
+			panels.SetCurrentTab("Interfaces")
+		case 'm', 'M':
+			if PimEnabled {
+				panels.SetCurrentTab("PIM")
+			}
+		case 'u', 'U':
+			if IgmpEnabled {
+				panels.SetCurrentTab("Queriers")
+			}
+		case 'w', 'W':
+			panels.SetCurrentTab("Sweep")
+		case 't', 'T':
+			if TraceSource.GetText() == "" {
+				TraceHelp()
+			}
+			panels.SetCurrentTab("Trace")
+		case 'e', 'E':
+			// Show the running configuration, which a reload may have changed
+			if panels.GetCurrentTab() != "Settings" {
+				MakeSettingsForm()
+				SettingsStatus.SetText("")
+			}
+			panels.SetCurrentTab("Settings")
 		case 'l', 'L':
 			panels.SetCurrentTab("Log")
 		case 'a', 'A':
 			panels.SetCurrentTab("About")
+		case 'x', 'X':
+			err := WriteSnapshot(ExportPath(time.Now()))
+			if err != nil {
+				Warn("Export: %v", err)
+			}
+			return nil
 		case 'q', 'Q':
 			app.Stop()
 		}
@@ -82,26 +365,45 @@ func View() {
 	})
 
 	UpdateReports()
+	UpdateHosts()
+	UpdateProblems()
+	UpdateGraphs()
+	UpdatePim()
+	UpdateQueriers()
+	UpdateSweep()
+	UpdateInterfaces()
 	go func() {
 		ticker := time.NewTicker(time.Second)
 		for range ticker.C {
 			UpdateReports()
+			UpdateHosts()
+			UpdateProblems()
+			UpdateGraphs()
+			UpdatePim()
+			UpdateQueriers()
+			UpdateSweep()
+			UpdateInterfaces()
 			app.Draw()
 		}
 	}()
 
 	app.SetRoot(panels, true)
+	LogMutex.Lock()
+	ViewRunning = true
+	LogMutex.Unlock()
 	err := app.Run()
+	LogMutex.Lock()
+	ViewRunning = false
+	LogMutex.Unlock()
 	if err != nil {
 		Fatal("%v", err)
 	}
 }
 
 func UpdateReports() {
-	Reports.Clear()
-
 	// Lock access to maps
 	Mutex.Lock()
+	Reports.Clear()
 
 	// Gather local IPs
 	localIPs := make(map[string]bool)
@@ -109,7 +411,177 @@ func UpdateReports() {
 		localIPs[s.IP.String()] = true
 	}
 
-	// Gather all IPs
+	// Find the cells on the failing side of one-way paths
+	now := Now()
+	missing := make(map[Asymmetry]bool)
+	for _, a := range FindAsymmetric(now) {
+		missing[Asymmetry{Hearer: a.Source, Source: a.Hearer}] = true
+	}
+	ips, hosts, ages, owner := ReportsMatrix(localIPs, now)
+	Reports.SetTitle(fmt.Sprintf(" Sort (S): %s | Problems only (O): %v | Search (/) ", SortOrders[SortOrder], ProblemsOnly))
+
+	if len(hosts) != 0 && len(ips) != 0 {
+		// Gather data
+		data := [][]string{append([]string{""}, hosts...)}
+		for _, ip := range ips {
+			row := []string{ip}
+			for _, host := range hosts {
+				d := ages[ip][host]
+				if d == 0 {
+					row = append(row, "")
+				} else {
+					row = append(row, fmt.Sprintf("%.3fs", d.Seconds()))
+				}
+			}
+			data = append(data, row)
+		}
+
+		// Update table
+		for r, row := range data {
+			for c, s := range row {
+				cell := cview.NewTableCell(s)
+				cell.SetAlign(cview.AlignRight)
+				if r == 0 && s == Host {
+					cell.SetTextColor(tcell.ColorAqua)
+				}
+				if c == 0 {
+					cell.SetAlign(cview.AlignLeft)
+					if localIPs[s] {
+						cell.SetTextColor(tcell.ColorAqua)
+					}
+				}
+				if r > 0 && c > 0 && missing[Asymmetry{Hearer: data[0][c], Source: owner[row[0]]}] {
+					cell.SetBackgroundColor(tcell.ColorDarkRed)
+				}
+				Reports.SetCell(r, c, cell)
+			}
+		}
+	}
+
+	// Unlock access to maps
+	Mutex.Unlock()
+}
+
+// ReportsMatrix returns the rows, columns, and ages shown in the Reports view after filtering and sorting, and the host that owns each IP. Mutex must be held.
+func ReportsMatrix(localIPs map[string]bool, now time.Time) (ips []string, hosts []string, ages map[string]map[string]time.Duration, owner map[string]string) {
+	owner = make(map[string]string)
+	for host, addrs := range HostAddrs() {
+		for _, ip := range addrs {
+			owner[ip] = host
+		}
+	}
+
+	// Gather IPs and hosts that match the filters
+	for _, ip := range GatherIPs(localIPs) {
+		if Matches(IPSearchRe, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	for _, host := range GatherHosts() {
+		if Matches(HostSearchRe, host) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	// Gather ages, and find the rows and columns with paths that are down
+	ages = make(map[string]map[string]time.Duration)
+	worstIP := make(map[string]time.Duration)
+	worstHost := make(map[string]time.Duration)
+	problemIP := make(map[string]bool)
+	problemHost := make(map[string]bool)
+	for _, ip := range ips {
+		ages[ip] = make(map[string]time.Duration)
+		for _, host := range hosts {
+			d := HeardAge(host, ip, now)
+			ages[ip][host] = d
+			if CanHear(host) && (d == 0 || d >= Stale) {
+				problemIP[ip] = true
+				problemHost[host] = true
+				d = Stale + time.Hour
+			}
+			if d > worstIP[ip] {
+				worstIP[ip] = d
+			}
+			if d > worstHost[host] {
+				worstHost[host] = d
+			}
+		}
+	}
+	if ProblemsOnly {
+		ips = Only(ips, problemIP)
+		hosts = Only(hosts, problemHost)
+	}
+
+	// Sort rows and columns
+	switch SortOrders[SortOrder] {
+	case "address":
+		sort.SliceStable(ips, func(i, j int) bool { return IPLess(ips[i], ips[j]) })
+	case "host":
+		sort.SliceStable(ips, func(i, j int) bool {
+			if owner[ips[i]] != owner[ips[j]] {
+				return owner[ips[i]] < owner[ips[j]]
+			}
+			return IPLess(ips[i], ips[j])
+		})
+	case "staleness":
+		sort.SliceStable(ips, func(i, j int) bool { return worstIP[ips[i]] > worstIP[ips[j]] })
+		sort.SliceStable(hosts, func(i, j int) bool { return worstHost[hosts[i]] > worstHost[hosts[j]] })
+	}
+	return ips, hosts, ages, owner
+}
+
+func LogTitle() {
+	LogMutex.Lock()
+	Log.SetTitle(fmt.Sprintf(" Level (V): %s and above | Search (/) ", LevelNames[LogLevel]))
+	LogMutex.Unlock()
+}
+
+// Matches reports whether s matches re, a nil re matches everything. A search that times out matches nothing from then on, so it cannot hold up every update. Mutex must be held.
+func Matches(re *regexp2.Regexp, s string) bool {
+	if re == nil {
+		return true
+	}
+	if SearchTimeouts[re] {
+		return false
+	}
+	match, err := re.MatchString(s)
+	if err != nil {
+		Debug("Regexp.MatchString(%s): %v", s, err)
+		SearchTimeouts[re] = true
+		return false
+	}
+	return match
+}
+
+// Only returns the items that are in keep
+func Only(items []string, keep map[string]bool) (z []string) {
+	for _, item := range items {
+		if keep[item] {
+			z = append(z, item)
+		}
+	}
+	return z
+}
+
+// IPLess orders IPs numerically, with IPv4 before IPv6 and anything else last
+func IPLess(a string, b string) bool {
+	ipa, ipb := net.ParseIP(a), net.ParseIP(b)
+	switch {
+	case ipa == nil && ipb == nil:
+		return a < b
+	case ipa == nil:
+		return false
+	case ipb == nil:
+		return true
+	}
+	if (ipa.To4() == nil) != (ipb.To4() == nil) {
+		return ipa.To4() != nil
+	}
+	return bytes.Compare(ipa.To16(), ipb.To16()) < 0
+}
+
+// GatherIPs returns every local and heard IP. Mutex must be held.
+func GatherIPs(localIPs map[string]bool) (ips []string) {
 	allIPs := make(map[string]bool)
 	for ip := range localIPs {
 		allIPs[ip] = true
@@ -122,71 +594,139 @@ func UpdateReports() {
 			allIPs[ip] = true
 		}
 	}
-	var ips []string
 	for ip := range allIPs {
 		ips = append(ips, ip)
 	}
 	sort.Strings(ips)
+	return ips
+}
 
-	// Gather hosts
+// GatherHosts returns every host that has reported, including this one. Mutex must be held.
+func GatherHosts() (hosts []string) {
 	allHosts := make(map[string]bool)
-	allHosts[Host] = true
+	if Role != "collector" {
+		allHosts[Host] = true
+	}
 	for host := range HeardHosts {
 		allHosts[host] = true
 	}
-	var hosts []string
 	for host := range allHosts {
 		hosts = append(hosts, host)
 	}
 	sort.Strings(hosts)
+	return hosts
+}
 
-	if len(hosts) != 0 && len(ips) != 0 {
-		// Gather data
-		now := time.Now()
-		data := [][]string{append([]string{""}, hosts...)}
+func UpdateHosts() {
+	// Lock access to maps
+	Mutex.Lock()
+	Hosts.Clear()
+
+	localIPs := make(map[string]bool)
+	for _, s := range Senders {
+		localIPs[s.IP.String()] = true
+	}
+	hosts := GatherHosts()
+
+	// Group IPs by the host they belong to, IPs of unknown hosts are grouped together
+	addrs := HostAddrs()
+	owned := make(map[string]bool)
+	var sources []string
+	for host, ips := range addrs {
+		if len(ips) == 0 {
+			continue
+		}
+		sources = append(sources, host)
 		for _, ip := range ips {
-			row := []string{ip}
-			for _, host := range hosts {
-				var t time.Time
-				var d time.Duration
+			owned[ip] = true
+		}
+	}
+	sort.Strings(sources)
+	for _, ip := range GatherIPs(localIPs) {
+		if !owned[ip] {
+			addrs["(unknown)"] = append(addrs["(unknown)"], ip)
+		}
+	}
+	if len(addrs["(unknown)"]) != 0 {
+		sources = append(sources, "(unknown)")
+	}
 
-				if host == Host {
-					t = HeardIPs[ip]
-					if !t.IsZero() {
-						d = now.Sub(t)
-					}
-				} else {
-					d = HeardDb[host][ip]
-					if d != 0 {
-						d += now.Sub(HeardHosts[host])
-					}
+	now := Now()
+	HostRows = []string{""}
+	for c, host := range hosts {
+		cell := cview.NewTableCell(host)
+		cell.SetAlign(cview.AlignRight)
+		cell.SetSelectable(false)
+		if host == Host {
+			cell.SetTextColor(tcell.ColorAqua)
+		}
+		Hosts.SetCell(0, c+1, cell)
+	}
+	r := 1
+	for _, source := range sources {
+		prefix := "+ "
+		if HostsExpanded[source] {
+			prefix = "- "
+		}
+		cell := cview.NewTableCell(prefix + source)
+		if source == Host {
+			cell.SetTextColor(tcell.ColorAqua)
+		}
+		Hosts.SetCell(r, 0, cell)
+
+		// Summarize how many of the source's IPs each host hears, with the worst age
+		for c, host := range hosts {
+			var heard int
+			var worst time.Duration
+			for _, ip := range addrs[source] {
+				d := HeardAge(host, ip, now)
+				if d != 0 && d < Stale {
+					heard++
 				}
-
-				if d == 0 {
-					row = append(row, "")
-				} else {
-					row = append(row, fmt.Sprintf("%.3fs", d.Seconds()))
+				if d > worst {
+					worst = d
 				}
 			}
-			data = append(data, row)
+			text := fmt.Sprintf("%d/%d", heard, len(addrs[source]))
+			if worst != 0 {
+				text += fmt.Sprintf(" %.3fs", worst.Seconds())
+			}
+			cell := cview.NewTableCell(text)
+			cell.SetAlign(cview.AlignRight)
+			switch heard {
+			case len(addrs[source]):
+				cell.SetTextColor(tcell.ColorGreen)
+			case 0:
+				cell.SetTextColor(tcell.ColorRed)
+			default:
+				cell.SetTextColor(tcell.ColorYellow)
+			}
+			Hosts.SetCell(r, c+1, cell)
 		}
+		HostRows = append(HostRows, source)
+		r++
 
-		// Update table
-		for r, row := range data {
-			for c, s := range row {
-				cell := cview.NewTableCell(s)
-				cell.SetAlign(cview.AlignRight)
-				if r == 0 && s == Host {
-					cell.SetTextColor(tcell.ColorAqua)
-				}
-				if c == 0 {
-					cell.SetAlign(cview.AlignLeft)
-					if localIPs[s] {
-						cell.SetTextColor(tcell.ColorAqua)
-					}
+		// Expanded hosts show the age of each IP
+		if !HostsExpanded[source] {
+			continue
+		}
+		for _, ip := range addrs[source] {
+			cell := cview.NewTableCell("    " + ip)
+			if localIPs[ip] {
+				cell.SetTextColor(tcell.ColorAqua)
+			}
+			Hosts.SetCell(r, 0, cell)
+			for c, host := range hosts {
+				text := ""
+				if d := HeardAge(host, ip, now); d != 0 {
+					text = fmt.Sprintf("%.3fs", d.Seconds())
 				}
-				Reports.SetCell(r, c, cell)
+				cell := cview.NewTableCell(text)
+				cell.SetAlign(cview.AlignRight)
+				Hosts.SetCell(r, c+1, cell)
 			}
+			HostRows = append(HostRows, source)
+			r++
 		}
 	}
 
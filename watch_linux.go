@@ -0,0 +1,100 @@
+// Copyright 2024 Eric Johnson
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"syscall"
+	"unsafe"
+)
+
+// WatchInterfaces subscribes to rtnetlink link and address notifications so sockets are updated as soon as interfaces change
+func WatchInterfaces(changed chan<- struct{}) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		Warn("Netlink: unix.Socket: %v", err)
+		return
+	}
+
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	err = unix.Bind(fd, sa)
+	if err != nil {
+		Warn("Netlink: unix.Bind: %v", err)
+		unix.Close(fd)
+		return
+	}
+	Info("Watching for interface and address changes with netlink")
+
+	go func() {
+		b := make([]byte, 65536)
+		for {
+			n, _, err := unix.Recvfrom(fd, b, 0)
+			if err != nil {
+				if errors.Is(err, unix.EINTR) {
+					continue
+				}
+				if errors.Is(err, unix.ENOBUFS) {
+					// Notifications were dropped, so assume something changed
+					Debug("Netlink: receive buffer overflowed")
+					Notify(changed)
+					continue
+				}
+				Warn("Netlink: unix.Recvfrom: %v", err)
+				unix.Close(fd)
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(b[:n])
+			if err != nil {
+				Debug("Netlink: syscall.ParseNetlinkMessage: %v", err)
+				continue
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+					if len(m.Data) >= unix.SizeofIfInfomsg {
+						ifi := (*unix.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+						Debug("Netlink: %s for interface %d", NetlinkType(m.Header.Type), ifi.Index)
+					}
+					Notify(changed)
+				case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+					if len(m.Data) >= unix.SizeofIfAddrmsg {
+						ifa := (*unix.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+						Debug("Netlink: %s for interface %d", NetlinkType(m.Header.Type), ifa.Index)
+					}
+					Notify(changed)
+				}
+			}
+		}
+	}()
+}
+
+func NetlinkType(t uint16) string {
+	switch t {
+	case unix.RTM_NEWLINK:
+		return "RTM_NEWLINK"
+	case unix.RTM_DELLINK:
+		return "RTM_DELLINK"
+	case unix.RTM_NEWADDR:
+		return "RTM_NEWADDR"
+	case unix.RTM_DELADDR:
+		return "RTM_DELADDR"
+	}
+	return "unknown"
+}
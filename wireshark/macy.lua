@@ -0,0 +1,387 @@
+-- Copyright 2024 Eric Johnson
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+-- http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Wireshark dissector for macy reports, following Encode0, Encode1, and Encode2 in reports.go.
+-- It is maintained by hand, so changes to the encoding must be made here as well.
+-- Copy to the Wireshark personal plugins folder. Reports are compressed with zstd, which
+-- Wireshark 4.4 and later can decompress from Lua; older versions only show the header.
+
+local macy = Proto("macy", "Macy multicast report")
+
+local f = macy.fields
+f.magic = ProtoField.string("macy.magic", "Magic")
+f.version = ProtoField.uint8("macy.version", "Protocol version")
+f.compressed = ProtoField.bytes("macy.compressed", "Compressed report")
+f.host = ProtoField.string("macy.host", "Host")
+f.seq = ProtoField.uint32("macy.seq", "Sequence")
+f.part = ProtoField.uint16("macy.part", "Part")
+f.total = ProtoField.uint16("macy.total", "Total parts")
+f.flags = ProtoField.uint8("macy.flags", "Flags", base.HEX)
+f.delta = ProtoField.bool("macy.flags.delta", "Delta-encoded addresses", 8, nil, 0x01)
+f.haslocal = ProtoField.bool("macy.flags.local", "Local addresses present", 8, nil, 0x02)
+f.beacon = ProtoField.bool("macy.flags.beacon", "Beacon", 8, nil, 0x04)
+f.stamped = ProtoField.bool("macy.flags.ttl", "TTL stamped", 8, nil, 0x08)
+f.hasminttl = ProtoField.bool("macy.flags.minttl", "Minimum TTLs present", 8, nil, 0x10)
+f.probe = ProtoField.bool("macy.flags.probe", "MTU probe", 8, nil, 0x20)
+f.haslargest = ProtoField.bool("macy.flags.largest", "Largest probes present", 8, nil, 0x40)
+f.localip = ProtoField.string("macy.local", "Local address")
+f.probesize = ProtoField.uint16("macy.probe", "Probe size")
+f.largest = ProtoField.string("macy.largest", "Largest probe heard")
+f.ttl = ProtoField.uint8("macy.ttl", "Sent with TTL")
+f.minttl = ProtoField.string("macy.minttl", "Minimum TTL heard")
+f.heard = ProtoField.string("macy.heard", "Heard")
+f.heardip = ProtoField.string("macy.heard.ip", "Address")
+f.age = ProtoField.double("macy.heard.age", "Seconds since heard")
+
+local ef_truncated = ProtoExpert.new("macy.truncated", "Report is truncated", expert.group.MALFORMED, expert.severity.ERROR)
+local ef_malformed = ProtoExpert.new("macy.malformed", "Report is malformed", expert.group.MALFORMED, expert.severity.ERROR)
+macy.experts = { ef_truncated, ef_malformed }
+
+-- The case of each letter of the magic is one bit of the version
+local function version(magic)
+	local v = 0
+	for i = 1, 4 do
+		local c = magic:sub(i, i)
+		if c == c:upper() then
+			v = v + 2 ^ (i - 1)
+		end
+	end
+	return math.floor(v)
+end
+
+local function uvarint(tvb, offset)
+	local v, scale = 0, 1
+	while offset < tvb:len() do
+		local b = tvb(offset, 1):uint()
+		offset = offset + 1
+		v = v + (b % 128) * scale
+		if b < 128 then
+			return v, offset
+		end
+		scale = scale * 128
+	end
+	return nil, offset
+end
+
+-- has returns whether n bytes remain at offset, marking the report truncated when they do not
+local function has(tvb, offset, n, tree)
+	if offset ~= nil and offset + n <= tvb:len() then
+		return true
+	end
+	tree:add_proto_expert_info(ef_truncated)
+	return false
+end
+
+-- varint reads a uvarint, marking the report truncated when it runs past the end
+local function varint(tvb, offset, tree)
+	local v
+	v, offset = uvarint(tvb, offset)
+	if v == nil then
+		tree:add_proto_expert_info(ef_truncated)
+	end
+	return v, offset
+end
+
+-- family returns the size of the addresses of a family tag, or nil with the report marked malformed for other tags
+local function family(tag, tree)
+	if tag == 4 then
+		return 4
+	elseif tag == 6 then
+		return 16
+	end
+	tree:add_proto_expert_info(ef_malformed, string.format("Unknown address family %d", tag))
+	return nil
+end
+
+local function address(bytes)
+	if bytes:len() == 4 then
+		return tostring(bytes:ipv4())
+	end
+	return tostring(bytes:ipv6())
+end
+
+-- Records of a length, the address as text, and nanoseconds as a big-endian uint64, as in Encode0 and Encode1
+local function heard_text(tvb, offset, tree)
+	while offset < tvb:len() do
+		local l = tvb(offset, 1):uint()
+		if l == 0 then
+			offset = offset + 1
+		else
+			if offset + 1 + l + 8 > tvb:len() then
+				tree:add_proto_expert_info(ef_truncated)
+				break
+			end
+			local ip = tvb(offset + 1, l):string()
+			local age = tvb(offset + 1 + l, 8):uint64():tonumber() / 1e9
+			local t = tree:add(f.heard, tvb(offset, 1 + l + 8), string.format("%s %.3fs", ip, age))
+			t:add(f.heardip, tvb(offset + 1, l))
+			t:add(f.age, tvb(offset + 1 + l, 8), age)
+			offset = offset + 1 + l + 8
+		end
+	end
+end
+
+-- Records of a family tag of 4, 6, or 0 for text, the address, and milliseconds as a uvarint, as in Encode2
+local function heard_binary(tvb, offset, tree, delta)
+	local prev = { [4] = nil, [6] = nil }
+	while offset < tvb:len() do
+		local start = offset
+		local tag = tvb(offset, 1):uint()
+		offset = offset + 1
+		local ip
+		if tag == 0 then
+			if not has(tvb, offset, 1, tree) then
+				return
+			end
+			local l = tvb(offset, 1):uint()
+			if not has(tvb, offset + 1, l, tree) then
+				return
+			end
+			ip = l > 0 and tvb(offset + 1, l):string() or ""
+			offset = offset + 1 + l
+		else
+			local size = family(tag, tree)
+			if size == nil then
+				return
+			end
+			local shared = 0
+			if delta then
+				if not has(tvb, offset, 1, tree) then
+					return
+				end
+				shared = tvb(offset, 1):uint()
+				offset = offset + 1
+			end
+			-- Encode2 always sends the last byte, and only shares bytes with an earlier address
+			if shared >= size or (shared > 0 and prev[tag] == nil) then
+				tree:add_proto_expert_info(ef_malformed, string.format("Address shares %d bytes with no earlier address to share them", shared))
+				return
+			end
+			if not has(tvb, offset, size - shared, tree) then
+				return
+			end
+			local bytes = ByteArray.new()
+			if shared > 0 then
+				bytes:append(prev[tag]:subset(0, shared))
+			end
+			bytes:append(tvb(offset, size - shared):bytes())
+			offset = offset + size - shared
+			prev[tag] = bytes
+			ip = address(bytes:tvb("Address"):range())
+		end
+		local ms
+		ms, offset = varint(tvb, offset, tree)
+		if ms == nil then
+			return
+		end
+		local t = tree:add(f.heard, tvb(start, offset - start), string.format("%s %.3fs", ip, ms / 1000))
+		t:add(f.heardip, ip)
+		t:add(f.age, ms / 1000)
+	end
+end
+
+-- addr_values adds a count of addresses each followed by a uvarint, as in AppendAddrValues, returning nil when it is malformed
+local function addr_values(tvb, offset, tree, field)
+	local n
+	n, offset = varint(tvb, offset, tree)
+	if n == nil then
+		return nil
+	end
+	for _ = 1, n do
+		local start = offset
+		if not has(tvb, offset, 1, tree) then
+			return nil
+		end
+		local size = family(tvb(offset, 1):uint(), tree)
+		if size == nil or not has(tvb, offset + 1, size, tree) then
+			return nil
+		end
+		local ip = address(tvb(offset + 1, size))
+		local value
+		value, offset = varint(tvb, offset + 1 + size, tree)
+		if value == nil then
+			return nil
+		end
+		tree:add(field, tvb(start, offset - start), string.format("%s %d", ip, value))
+	end
+	return offset
+end
+
+local function report(tvb, v, tree, pinfo)
+	if not has(tvb, 0, 1, tree) then
+		return
+	end
+	local l = tvb(0, 1):uint()
+	if not has(tvb, 1, l, tree) then
+		return
+	end
+	local host = ""
+	if l > 0 then
+		host = tvb(1, l):string()
+		tree:add(f.host, tvb(1, l))
+	end
+	local offset = 1 + l
+	local info = "Report from " .. host
+	pinfo.cols.info = info
+
+	if v == 1 then
+		if not has(tvb, offset, 8, tree) then
+			return
+		end
+		tree:add(f.seq, tvb(offset, 4))
+		tree:add(f.part, tvb(offset + 4, 2))
+		tree:add(f.total, tvb(offset + 6, 2))
+		info = string.format("%s, part %d of %d", info, tvb(offset + 4, 2):uint() + 1, tvb(offset + 6, 2):uint())
+		offset = offset + 8
+	elseif v == 2 then
+		local seq, part, total
+		seq, offset = varint(tvb, offset, tree)
+		if seq ~= nil then
+			part, offset = varint(tvb, offset, tree)
+		end
+		if part ~= nil then
+			total, offset = varint(tvb, offset, tree)
+		end
+		if total == nil or not has(tvb, offset, 1, tree) then
+			return
+		end
+		tree:add(f.seq, seq)
+		tree:add(f.part, part)
+		tree:add(f.total, total)
+		info = string.format("%s, part %d of %d", info, part + 1, total)
+		pinfo.cols.info = info
+		local flags = tvb(offset, 1):uint()
+		local ft = tree:add(f.flags, tvb(offset, 1))
+		ft:add(f.delta, tvb(offset, 1))
+		ft:add(f.haslocal, tvb(offset, 1))
+		ft:add(f.beacon, tvb(offset, 1))
+		ft:add(f.stamped, tvb(offset, 1))
+		ft:add(f.hasminttl, tvb(offset, 1))
+		ft:add(f.probe, tvb(offset, 1))
+		ft:add(f.haslargest, tvb(offset, 1))
+		offset = offset + 1
+		if math.floor(flags / 8) % 2 == 1 then
+			local start, ttl = offset, nil
+			ttl, offset = varint(tvb, offset, tree)
+			if ttl == nil then
+				return
+			end
+			tree:add(f.ttl, tvb(start, offset - start), ttl)
+			info = string.format("%s, TTL %d", info, ttl)
+			pinfo.cols.info = info
+		end
+		if math.floor(flags / 32) % 2 == 1 then
+			local start, size = offset, nil
+			size, offset = varint(tvb, offset, tree)
+			if size == nil then
+				return
+			end
+			tree:add(f.probesize, tvb(start, offset - start), size)
+			info = string.format("MTU probe of %d bytes from %s", size, host)
+			pinfo.cols.info = info
+		end
+		if math.floor(flags / 2) % 2 == 1 then
+			local n
+			n, offset = varint(tvb, offset, tree)
+			if n == nil then
+				return
+			end
+			for _ = 1, n do
+				if not has(tvb, offset, 1, tree) then
+					return
+				end
+				local tag = tvb(offset, 1):uint()
+				if tag == 0 then
+					if not has(tvb, offset + 1, 1, tree) then
+						return
+					end
+					local sl = tvb(offset + 1, 1):uint()
+					if not has(tvb, offset + 2, sl, tree) then
+						return
+					end
+					if sl > 0 then
+						tree:add(f.localip, tvb(offset + 2, sl))
+					end
+					offset = offset + 2 + sl
+				else
+					local size = family(tag, tree)
+					if size == nil or not has(tvb, offset + 1, size, tree) then
+						return
+					end
+					tree:add(f.localip, tvb(offset, 1 + size), address(tvb(offset + 1, size)))
+					offset = offset + 1 + size
+				end
+			end
+		end
+		if math.floor(flags / 16) % 2 == 1 then
+			offset = addr_values(tvb, offset, tree, f.minttl)
+			if offset == nil then
+				return
+			end
+		end
+		if math.floor(flags / 64) % 2 == 1 then
+			offset = addr_values(tvb, offset, tree, f.largest)
+			if offset == nil then
+				return
+			end
+		end
+		heard_binary(tvb, offset, tree, flags % 2 == 1)
+		return
+	end
+
+	heard_text(tvb, offset, tree)
+	pinfo.cols.info = info
+end
+
+function macy.dissector(tvb, pinfo, tree)
+	if tvb:len() < 8 or tvb(0, 4):string():upper() ~= "MACY" then
+		return 0
+	end
+	pinfo.cols.protocol = "MACY"
+	local magic = tvb(0, 4):string()
+	local v = version(magic)
+	local t = tree:add(macy, tvb(), "Macy report")
+	t:add(f.magic, tvb(0, 4))
+	t:add(f.version, tvb(0, 4), v)
+	t:add(f.compressed, tvb(4))
+
+	local range = tvb(4)
+	local found, uncompress = pcall(function() return range.uncompress_zstd end)
+	if not found or uncompress == nil then
+		pinfo.cols.info = "Compressed report, Wireshark 4.4 or later is needed to decode it"
+		return tvb:len()
+	end
+	local ok, plain = pcall(uncompress, range, "Decompressed report")
+	if ok and plain ~= nil and v <= 2 then
+		-- Anything the checks in report miss is shown as malformed rather than as a Lua error
+		local decoded, err = pcall(report, plain, v, t, pinfo)
+		if not decoded then
+			t:add_proto_expert_info(ef_malformed, tostring(err))
+		end
+	end
+	return tvb:len()
+end
+
+local function heuristic(tvb, pinfo, tree)
+	if tvb:len() < 8 or tvb(0, 4):string():upper() ~= "MACY" then
+		return false
+	end
+	macy.dissector(tvb, pinfo, tree)
+	return true
+end
+
+local udp = DissectorTable.get("udp.port")
+udp:add(23923, macy)
+udp:add(23924, macy)
+macy:register_heuristic("udp", heuristic)